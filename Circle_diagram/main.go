@@ -1,26 +1,37 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/tls"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"image"
 	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
 	"image/png"
+	"io"
 	"log"
 	"math"
 	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/golang/freetype"
-	"github.com/golang/freetype/truetype"
-	"golang.org/x/image/font"
-	"golang.org/x/image/font/basicfont"
-	"golang.org/x/image/math/fixed"
-
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -29,6 +40,9 @@ type Circle struct {
 	Y      int    `json:"y"`
 	Radius int    `json:"radius"`
 	Type   string `json:"type"`
+
+	// Произвольные данные клиента (название комнаты, сложность и т.п.)
+	Meta map[string]string `json:"meta,omitempty"`
 }
 
 type Config struct {
@@ -39,6 +53,127 @@ type Config struct {
 	SpawnR   int `json:"spawn_radius"`
 	BedroomR int `json:"bedroom_radius"`
 	MaxGap   int `json:"max_gap"`
+
+	// Лимиты попыток генерации (0 - значение по умолчанию)
+	PlacementAttempts int `json:"placement_attempts,omitempty"`
+	NearbyAttempts    int `json:"nearby_attempts,omitempty"`
+
+	// Общий бюджет проверок размещения на всю генерацию (0 - без ограничения)
+	MaxTotalAttempts int `json:"max_total_attempts,omitempty"`
+
+	// Дополнительный случайный разброс расстояния (в клетках) сверх max_gap
+	// при размещении круга рядом с существующим: чем больше, тем реже круги жмутся друг к другу
+	Jitter float64 `json:"jitter,omitempty"`
+
+	// Базовый круг для bedroom выбирается только среди spawn
+	BedroomsNearSpawns bool `json:"bedrooms_near_spawns,omitempty"`
+
+	// Первый spawn ставится точно в центр карты (по умолчанию true).
+	// При false все spawn размещаются случайно.
+	CenterSpawn *bool `json:"center_spawn,omitempty"`
+
+	// Точка, в которую ставится центр первого bedroom вместо случайного
+	// размещения рядом с существующими кругами (по умолчанию не задана)
+	BedroomAnchor *Anchor `json:"bedroom_anchor,omitempty"`
+
+	// Окрестность клетки для движения: "moore" (8 соседей, по умолчанию)
+	// или "von_neumann" (4 ортогональных соседа)
+	Neighborhood string `json:"neighborhood,omitempty"`
+
+	// Сохранять снимок клеток после каждой эпохи (история)
+	History bool `json:"history,omitempty"`
+
+	// Смещение случайного размещения кругов к области карты
+	Bias *PlacementBias `json:"bias,omitempty"`
+
+	// Стратегия размещения кругов: "random" (по умолчанию), "hex" или "ring"
+	Strategy string `json:"strategy,omitempty"`
+
+	// Радиус кольца spawn вокруг центра карты для стратегии "ring"
+	// (0 - наибольший радиус, при котором spawn помещаются в карту)
+	RingRadius int `json:"ring_radius,omitempty"`
+
+	// Радиус зеленого (непроходимого) ядра вокруг центра круга, 0 - одна клетка
+	CenterRadius int `json:"center_radius,omitempty"`
+
+	// Ширина непроходимой рамки (стены) по краям карты, 0 - без рамки.
+	// Круги размещаются только внутри рамки, числа в ней не хранятся.
+	Border int `json:"border,omitempty"`
+
+	// Общее число кругов и доля spawn среди них; используются,
+	// когда spawn_count и bedroom_count не заданы
+	TotalCircles int     `json:"total_circles,omitempty"`
+	SpawnRatio   float64 `json:"spawn_ratio,omitempty"`
+
+	// Профиль вместимости клеток по расстоянию от центра карты:
+	// "constant" (по умолчанию), "linear" или "inverse"
+	CapacityProfile string `json:"capacity_profile,omitempty"`
+
+	// Множители скорости чисел внутри кругов по типу круга (по умолчанию 1),
+	// например {"slow": 0.5}
+	SpeedMultipliers map[string]float64 `json:"speed_multipliers,omitempty"`
+
+	// Вероятности начального заполнения, если в newEpoch клеток еще нет
+	DefaultProbabilities []float64 `json:"default_probabilities,omitempty"`
+
+	// Максимум клеток в распределении карты (0 - без ограничения). При превышении
+	// распределение отклоняется или, если downsample_cells, случайно прореживается.
+	MaxCells        int  `json:"max_cells,omitempty"`
+	DownsampleCells bool `json:"downsample_cells,omitempty"`
+
+	// URL, на который после каждой эпохи асинхронно отправляется состояние клеток
+	WebhookURL string `json:"webhook_url,omitempty"`
+}
+
+// PlacementBias притягивает случайное размещение кругов к точке (X, Y).
+// Strength от 0 (равномерно) до 1 (максимальное притяжение).
+type PlacementBias struct {
+	X        int     `json:"x"`
+	Y        int     `json:"y"`
+	Strength float64 `json:"strength"`
+}
+
+// Anchor - фиксированная точка карты
+type Anchor struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+const (
+	neighborhoodMoore      = "moore"
+	neighborhoodVonNeumann = "von_neumann"
+)
+
+const (
+	strategyRandom = "random"
+	strategyHex    = "hex"
+	strategyRing   = "ring"
+)
+
+const (
+	defaultPlacementAttempts = 3000
+	defaultNearbyAttempts    = 30
+)
+
+// applyConfigDefaults заполняет незаданные поля конфигурации значениями по умолчанию
+func applyConfigDefaults(cfg *Config) {
+	if cfg.PlacementAttempts == 0 {
+		cfg.PlacementAttempts = defaultPlacementAttempts
+	}
+	if cfg.NearbyAttempts == 0 {
+		cfg.NearbyAttempts = defaultNearbyAttempts
+	}
+	if cfg.Spawns == 0 && cfg.Bedrooms == 0 && cfg.TotalCircles > 0 {
+		cfg.Spawns = int(math.Round(float64(cfg.TotalCircles) * cfg.SpawnRatio))
+		if cfg.Spawns == 0 {
+			cfg.Spawns = 1 // хотя бы один spawn при ненулевой доле
+		}
+		cfg.Bedrooms = cfg.TotalCircles - cfg.Spawns
+	}
+	if cfg.CenterSpawn == nil {
+		centerSpawn := true
+		cfg.CenterSpawn = &centerSpawn
+	}
 }
 
 type Map struct {
@@ -46,7 +181,15 @@ type Map struct {
 	Name    string    `json:"name"`
 	Config  Config    `json:"config"`
 	Circles []Circle  `json:"circles"`
-	Speeds  []float64 `json:"speeds,omitempty"`
+	Speeds  []float64 `json:"speeds"`
+	Epoch   int       `json:"epoch"`
+	Created time.Time `json:"created_at"`
+}
+
+// MapSummary - краткое описание карты для списков
+type MapSummary struct {
+	ID      int       `json:"id"`
+	Name    string    `json:"name"`
 	Epoch   int       `json:"epoch"`
 	Created time.Time `json:"created_at"`
 }
@@ -55,16 +198,69 @@ type Cell struct {
 	X    int   `json:"x"`
 	Y    int   `json:"y"`
 	Vals []int `json:"indices"`
+	Ages []int `json:"ages,omitempty"` // возраст чисел в эпохах, параллельно Vals
+
+	// Слой популяции: слои не взаимодействуют и не делят вместимость клеток
+	Layer int `json:"layer,omitempty"`
+}
+
+// splitLayers группирует клетки по слоям. Возвращает номера слоев по возрастанию;
+// слой 0 присутствует всегда.
+func splitLayers(cells []Cell) ([]int, map[int][]Cell) {
+	byLayer := map[int][]Cell{0: {}}
+	for _, cell := range cells {
+		byLayer[cell.Layer] = append(byLayer[cell.Layer], cell)
+	}
+	layers := make([]int, 0, len(byLayer))
+	for layer := range byLayer {
+		layers = append(layers, layer)
+	}
+	sort.Ints(layers)
+	return layers, byLayer
+}
+
+// setLayer проставляет слой всем клеткам
+func setLayer(cells []Cell, layer int) []Cell {
+	for i := range cells {
+		cells[i].Layer = layer
+	}
+	return cells
+}
+
+// age возвращает возраст i-го числа клетки (0, если возраст не отслеживается)
+func (c Cell) age(i int) int {
+	if i < len(c.Ages) {
+		return c.Ages[i]
+	}
+	return 0
+}
+
+// agesJSON сериализует возраст чисел для БД; пустая строка, если возраст не отслеживается
+func (c Cell) agesJSON() string {
+	if len(c.Ages) == 0 {
+		return ""
+	}
+	agesBytes, _ := json.Marshal(c.Ages)
+	return string(agesBytes)
 }
 
 // НОВЫЕ СТРУКТУРЫ ДЛЯ ИГРОКА
 type Player struct {
-	ID       int       `json:"id"`
-	MapID    int       `json:"map_id"`
-	X        int       `json:"x"`
-	Y        int       `json:"y"`
-	Name     string    `json:"name"`
-	Created  time.Time `json:"created_at"`
+	ID      int       `json:"id"`
+	MapID   int       `json:"map_id"`
+	X       int       `json:"x"`
+	Y       int       `json:"y"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created_at"`
+}
+
+// PartialGeneration описывает результат неудачной генерации при allow_partial
+type PartialGeneration struct {
+	Warning           string `json:"warning"`
+	PlacedSpawns      int    `json:"placed_spawns"`
+	PlacedBedrooms    int    `json:"placed_bedrooms"`
+	RequestedSpawns   int    `json:"requested_spawns"`
+	RequestedBedrooms int    `json:"requested_bedrooms"`
 }
 
 type SpawnPlayerRequest struct {
@@ -79,10 +275,68 @@ type MovePlayerRequest struct {
 type SetSpeedsRequest struct {
 	MapID  int       `json:"map_id"`
 	Speeds []float64 `json:"speeds"`
+	Preset string    `json:"preset"` // имя сохраненного пресета вместо speeds
+	Layer  int       `json:"layer"`  // слой популяции (0 - основной)
+
+	// Число знаков после запятой, до которого округляются скорости (0-6)
+	Precision *int `json:"precision,omitempty"`
+}
+
+const maxSpeedPrecision = 6
+
+// roundSpeeds округляет скорости до precision знаков после запятой
+func roundSpeeds(speeds []float64, precision int) []float64 {
+	factor := math.Pow(10, float64(precision))
+	rounded := make([]float64, len(speeds))
+	for i, speed := range speeds {
+		rounded[i] = math.Round(speed*factor) / factor
+	}
+	return rounded
+}
+
+// SpeedPreset - именованный набор скоростей
+type SpeedPreset struct {
+	Name   string    `json:"name"`
+	Speeds []float64 `json:"speeds"`
 }
 
 type NewEpochRequest struct {
-	MapID int `json:"map_id"`
+	MapID  int  `json:"map_id"`
+	Fill   bool `json:"fill"`    // дозаполнить карту согласно fill_rate
+	MaxAge int  `json:"max_age"` // максимальный возраст числа в эпохах (0 - бессмертны)
+
+	// Вероятность исчезновения каждого числа после движения (0..1)
+	Decay float64 `json:"decay"`
+
+	// Склонность чисел двигаться к соседям с тем же значением (0 - случайно)
+	Cohesion float64 `json:"cohesion"`
+
+	// Индексы значений, которые не двигаются (неподвижные ресурсы)
+	Immovable []int `json:"immovable"`
+
+	// Веса направлений движения: n, ne, e, se, s, sw, w, nw
+	DirectionWeights map[string]float64 `json:"direction_weights"`
+
+	// Поведение числа, когда все соседи заняты: stay, swap или wait-and-retry
+	WhenBlocked string `json:"when_blocked"`
+
+	// Матрица взаимодействий значений: [i][j] масштабирует шанс перехода
+	// значения i в клетку со значением j (по умолчанию 1)
+	ValueInteractions [][]float64 `json:"value_interactions"`
+
+	// Максимальная длина пути числа за эпоху: при значении больше 1 скорость
+	// задает ожидаемое число шагов speed/100 * max_steps_per_move
+	MaxStepsPerMove int `json:"max_steps_per_move"`
+
+	// Сортировка: lower - числа переходят только к меньшим значениям,
+	// higher - только к большим (по умолчанию без ограничения)
+	SortDirection string `json:"sort_direction"`
+
+	// Вернуть список перемещений чисел за эпоху (transitions)
+	Transitions bool `json:"transitions"`
+
+	// Вычислить следующее состояние без сохранения клеток и эпохи
+	DryRun bool `json:"dry_run"`
 }
 
 var db *sql.DB
@@ -97,6 +351,9 @@ func forceMigration() error {
 	}{
 		{"ALTER TABLE maps ADD COLUMN speeds TEXT DEFAULT '';", "speeds"},
 		{"ALTER TABLE maps ADD COLUMN epoch INTEGER DEFAULT 0;", "epoch"},
+		{"ALTER TABLE maps ADD COLUMN fill_state TEXT DEFAULT '';", "fill_state"},
+		{"ALTER TABLE maps ADD COLUMN layer_speeds TEXT DEFAULT '';", "layer_speeds"},
+		{"ALTER TABLE maps ADD COLUMN deleted_at DATETIME;", "deleted_at"},
 	}
 
 	for i, migration := range migrations {
@@ -125,7 +382,9 @@ func forceMigration() error {
 		map_id INTEGER NOT NULL,
 		x INTEGER NOT NULL,
 		y INTEGER NOT NULL,
+		layer INTEGER NOT NULL DEFAULT 0,
 		cell_values TEXT NOT NULL,
+		cell_ages TEXT NOT NULL DEFAULT '',
 		FOREIGN KEY(map_id) REFERENCES maps(id)
 	);`
 
@@ -137,6 +396,67 @@ func forceMigration() error {
 		log.Printf("   ✅ Таблица map_cells создана успешно")
 	}
 
+	// Таблица истории эпох
+	historyTable := `CREATE TABLE IF NOT EXISTS map_history (
+		map_id INTEGER NOT NULL,
+		epoch INTEGER NOT NULL,
+		cells TEXT NOT NULL,
+		PRIMARY KEY(map_id, epoch),
+		FOREIGN KEY(map_id) REFERENCES maps(id)
+	);`
+
+	_, err = db.Exec(historyTable)
+	if err != nil {
+		log.Printf("   ❌ Ошибка создания таблицы map_history: %v", err)
+	} else {
+		log.Printf("   ✅ Таблица map_history создана успешно")
+	}
+
+	// Таблица пресетов скоростей
+	presetsTable := `CREATE TABLE IF NOT EXISTS speed_presets (
+		name TEXT PRIMARY KEY,
+		speeds TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	_, err = db.Exec(presetsTable)
+	if err != nil {
+		log.Printf("   ❌ Ошибка создания таблицы speed_presets: %v", err)
+	} else {
+		log.Printf("   ✅ Таблица speed_presets создана успешно")
+	}
+
+	// Таблица ключей идемпотентности создания карт
+	idempotencyTable := `CREATE TABLE IF NOT EXISTS idempotency_keys (
+		key TEXT PRIMARY KEY,
+		map_id INTEGER NOT NULL,
+		created_at INTEGER NOT NULL
+	);`
+
+	_, err = db.Exec(idempotencyTable)
+	if err != nil {
+		log.Printf("   ❌ Ошибка создания таблицы idempotency_keys: %v", err)
+	} else {
+		log.Printf("   ✅ Таблица idempotency_keys создана успешно")
+	}
+
+	// Таблица пометок эпох
+	annotationsTable := `CREATE TABLE IF NOT EXISTS map_annotations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		map_id INTEGER NOT NULL,
+		epoch INTEGER NOT NULL,
+		label TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(map_id) REFERENCES maps(id)
+	);`
+
+	_, err = db.Exec(annotationsTable)
+	if err != nil {
+		log.Printf("   ❌ Ошибка создания таблицы map_annotations: %v", err)
+	} else {
+		log.Printf("   ✅ Таблица map_annotations создана успешно")
+	}
+
 	// НОВАЯ ТАБЛИЦА ДЛЯ ИГРОКОВ
 	log.Println("🔧 Создание таблицы игроков...")
 	playersTable := `CREATE TABLE IF NOT EXISTS players (
@@ -161,8 +481,13 @@ func forceMigration() error {
 }
 
 func initDB() error {
+	return openDB("./maps.db")
+}
+
+// openDB открывает базу по строке подключения и создает/мигрирует схему
+func openDB(dsn string) error {
 	var err error
-	db, err = sql.Open("sqlite3", "./maps.db")
+	db, err = sql.Open("sqlite3", dsn)
 	if err != nil {
 		return err
 	}
@@ -195,16 +520,47 @@ type MapGenerator struct {
 	config   Config
 	spawns   []Circle
 	bedrooms []Circle
+	rng      *rand.Rand // собственный генератор случайных чисел карты
+
+	// onPlace вызывается после размещения каждого круга (может быть nil)
+	onPlace func(c Circle)
+
+	// attempts - число проверок размещения за всю генерацию
+	attempts int
+}
+
+// budgetExhausted сообщает, исчерпан ли общий бюджет попыток генерации
+func (g *MapGenerator) budgetExhausted() bool {
+	return g.config.MaxTotalAttempts > 0 && g.attempts >= g.config.MaxTotalAttempts
+}
+
+func (g *MapGenerator) addSpawn(c Circle) {
+	g.spawns = append(g.spawns, c)
+	if g.onPlace != nil {
+		c.Type = "spawn"
+		g.onPlace(c)
+	}
+}
+
+func (g *MapGenerator) addBedroom(c Circle) {
+	g.bedrooms = append(g.bedrooms, c)
+	if g.onPlace != nil {
+		c.Type = "bedroom"
+		g.onPlace(c)
+	}
 }
 
 func NewMapGenerator(cfg Config) *MapGenerator {
+	applyConfigDefaults(&cfg)
 	return &MapGenerator{
 		config:   cfg,
 		spawns:   []Circle{},
 		bedrooms: []Circle{},
+		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 }
 
+// getAllCircles возвращает копии кругов с проставленным типом; Meta сохраняется
 func (g *MapGenerator) getAllCircles() []Circle {
 	all := []Circle{}
 	for _, c := range g.spawns {
@@ -219,11 +575,29 @@ func (g *MapGenerator) getAllCircles() []Circle {
 }
 
 func (g *MapGenerator) canPlaceCircle(newCircle Circle) bool {
-	if newCircle.X-newCircle.Radius < 0 || newCircle.X+newCircle.Radius >= g.config.Width ||
-		newCircle.Y-newCircle.Radius < 0 || newCircle.Y+newCircle.Radius >= g.config.Height {
+	if g.budgetExhausted() {
+		return false
+	}
+	g.attempts++
+	return canPlaceAmong(g.config, g.getAllCircles(), newCircle)
+}
+
+// outOfBounds сообщает, что круг выходит за границы карты или заходит в её рамку
+func outOfBounds(cfg Config, c Circle) bool {
+	b := cfg.Border
+	return c.X-c.Radius < b || c.X+c.Radius >= cfg.Width-b ||
+		c.Y-c.Radius < b || c.Y+c.Radius >= cfg.Height-b
+}
+
+// canPlaceAmong проверяет, что круг помещается на карту и не пересекает существующие
+func canPlaceAmong(cfg Config, circles []Circle, newCircle Circle) bool {
+	if outOfBounds(cfg, newCircle) {
 		return false
 	}
-	for _, existing := range g.getAllCircles() {
+	for _, existing := range circles {
+		if sameCenter(newCircle, existing) {
+			return false
+		}
 		distance := math.Sqrt(float64((newCircle.X-existing.X)*(newCircle.X-existing.X) +
 			(newCircle.Y-existing.Y)*(newCircle.Y-existing.Y)))
 		if distance < float64(newCircle.Radius+existing.Radius) {
@@ -233,12 +607,49 @@ func (g *MapGenerator) canPlaceCircle(newCircle Circle) bool {
 	return true
 }
 
+// sameCenter сообщает, что у кругов общий центр. Такие круги конфликтуют при
+// любых радиусах, в том числе нулевых, для которых проверка пересечения не срабатывает.
+func sameCenter(a, b Circle) bool {
+	return a.X == b.X && a.Y == b.Y
+}
+
+// CircleConflict описывает некорректный круг при импорте: пересечение или общий
+// центр двух кругов (A и B) или выход круга A за границы карты (B = -1)
+type CircleConflict struct {
+	A      int    `json:"a"`
+	B      int    `json:"b"`
+	Reason string `json:"reason"`
+}
+
+// findCircleConflicts проверяет круги по тем же правилам, что и canPlaceCircle
+func findCircleConflicts(cfg Config, circles []Circle) []CircleConflict {
+	conflicts := []CircleConflict{}
+	for i, c := range circles {
+		if outOfBounds(cfg, c) {
+			conflicts = append(conflicts, CircleConflict{A: i, B: -1, Reason: "out_of_bounds"})
+		}
+		for j := i + 1; j < len(circles); j++ {
+			o := circles[j]
+			distance := math.Sqrt(float64((c.X-o.X)*(c.X-o.X) + (c.Y-o.Y)*(c.Y-o.Y)))
+			if sameCenter(c, o) {
+				conflicts = append(conflicts, CircleConflict{A: i, B: j, Reason: "same_center"})
+			} else if distance < float64(c.Radius+o.Radius) {
+				conflicts = append(conflicts, CircleConflict{A: i, B: j, Reason: "overlap"})
+			}
+		}
+	}
+	return conflicts
+}
+
 func (g *MapGenerator) generateNearbyPosition(baseCircle Circle, radius int) (int, int) {
-	for attempts := 0; attempts < 30; attempts++ {
-		angle := rand.Float64() * 2 * math.Pi
+	for attempts := 0; attempts < g.config.NearbyAttempts; attempts++ {
+		angle := g.rng.Float64() * 2 * math.Pi
 		minDistance := float64(baseCircle.Radius + radius)
 		maxDistance := minDistance + float64(g.config.MaxGap)
-		distance := minDistance + rand.Float64()*(maxDistance-minDistance)
+		distance := minDistance + g.rng.Float64()*(maxDistance-minDistance)
+		if g.config.Jitter > 0 {
+			distance += g.rng.Float64() * g.config.Jitter
+		}
 
 		x := int(float64(baseCircle.X) + distance*math.Cos(angle))
 		y := int(float64(baseCircle.Y) + distance*math.Sin(angle))
@@ -247,40 +658,66 @@ func (g *MapGenerator) generateNearbyPosition(baseCircle Circle, radius int) (in
 			return x, y
 		}
 	}
-	x := radius + rand.Intn(g.config.Width-2*radius)
-	y := radius + rand.Intn(g.config.Height-2*radius)
+	return g.randomPosition(radius)
+}
+
+// randomPosition выбирает случайную позицию круга на карте. При заданном
+// смещении (Bias) точка притягивается к точке смещения с силой Strength.
+func (g *MapGenerator) randomPosition(radius int) (int, int) {
+	x := radius + g.rng.Intn(g.config.Width-2*radius)
+	y := radius + g.rng.Intn(g.config.Height-2*radius)
+	if b := g.config.Bias; b != nil && b.Strength > 0 {
+		pull := b.Strength * g.rng.Float64()
+		x += int(math.Round(pull * float64(b.X-x)))
+		y += int(math.Round(pull * float64(b.Y-y)))
+		x = int(math.Max(float64(radius), math.Min(float64(x), float64(g.config.Width-radius-1))))
+		y = int(math.Max(float64(radius), math.Min(float64(y), float64(g.config.Height-radius-1))))
+	}
 	return x, y
 }
 
 func (g *MapGenerator) Generate() error {
-	rand.Seed(time.Now().UnixNano())
+	err := g.generate()
+	if err != nil && g.budgetExhausted() {
+		return fmt.Errorf("исчерпан общий бюджет попыток (%d), размещено кругов: %d",
+			g.config.MaxTotalAttempts, len(g.spawns)+len(g.bedrooms))
+	}
+	return err
+}
+
+func (g *MapGenerator) generate() error {
+	switch g.config.Strategy {
+	case strategyHex:
+		return g.generateHex()
+	case strategyRing:
+		return g.generateRing()
+	}
 
-	if g.config.Spawns > 0 {
+	if g.config.Spawns > 0 && *g.config.CenterSpawn {
 		center := Circle{
 			X:      g.config.Width / 2,
 			Y:      g.config.Height / 2,
 			Radius: g.config.SpawnR,
 		}
 		if g.canPlaceCircle(center) {
-			g.spawns = append(g.spawns, center)
+			g.addSpawn(center)
 		}
 	}
 
 	for i := len(g.spawns); i < g.config.Spawns; i++ {
 		placed := false
-		for attempts := 0; attempts < 3000; attempts++ {
+		for attempts := 0; attempts < g.config.PlacementAttempts && !g.budgetExhausted(); attempts++ {
 			var x, y int
 			existing := g.getAllCircles()
 			if len(existing) > 0 {
-				base := existing[rand.Intn(len(existing))]
+				base := existing[g.rng.Intn(len(existing))]
 				x, y = g.generateNearbyPosition(base, g.config.SpawnR)
 			} else {
-				x = g.config.SpawnR + rand.Intn(g.config.Width-2*g.config.SpawnR)
-				y = g.config.SpawnR + rand.Intn(g.config.Height-2*g.config.SpawnR)
+				x, y = g.randomPosition(g.config.SpawnR)
 			}
 			newCircle := Circle{X: x, Y: y, Radius: g.config.SpawnR}
 			if g.canPlaceCircle(newCircle) {
-				g.spawns = append(g.spawns, newCircle)
+				g.addSpawn(newCircle)
 				placed = true
 				break
 			}
@@ -289,22 +726,38 @@ func (g *MapGenerator) Generate() error {
 			return fmt.Errorf("не удалось разместить spawn %d", i+1)
 		}
 	}
+	return g.placeBedrooms()
+}
 
-	for i := 0; i < g.config.Bedrooms; i++ {
+// placeBedrooms размещает bedroom случайно рядом с уже стоящими кругами.
+// При заданном BedroomAnchor первый bedroom ставится точно в эту точку.
+func (g *MapGenerator) placeBedrooms() error {
+	start := 0
+	if a := g.config.BedroomAnchor; a != nil && g.config.Bedrooms > 0 {
+		anchored := Circle{X: a.X, Y: a.Y, Radius: g.config.BedroomR}
+		if !g.canPlaceCircle(anchored) {
+			return fmt.Errorf("не удалось разместить bedroom 1 в точке (%d, %d)", a.X, a.Y)
+		}
+		g.addBedroom(anchored)
+		start = 1
+	}
+	for i := start; i < g.config.Bedrooms; i++ {
 		placed := false
-		for attempts := 0; attempts < 3000; attempts++ {
+		for attempts := 0; attempts < g.config.PlacementAttempts && !g.budgetExhausted(); attempts++ {
 			var x, y int
 			existing := g.getAllCircles()
+			if g.config.BedroomsNearSpawns {
+				existing = g.spawns
+			}
 			if len(existing) > 0 {
-				base := existing[rand.Intn(len(existing))]
+				base := existing[g.rng.Intn(len(existing))]
 				x, y = g.generateNearbyPosition(base, g.config.BedroomR)
 			} else {
-				x = g.config.BedroomR + rand.Intn(g.config.Width-2*g.config.BedroomR)
-				y = g.config.BedroomR + rand.Intn(g.config.Height-2*g.config.BedroomR)
+				x, y = g.randomPosition(g.config.BedroomR)
 			}
 			newCircle := Circle{X: x, Y: y, Radius: g.config.BedroomR}
 			if g.canPlaceCircle(newCircle) {
-				g.bedrooms = append(g.bedrooms, newCircle)
+				g.addBedroom(newCircle)
 				placed = true
 				break
 			}
@@ -316,862 +769,6495 @@ func (g *MapGenerator) Generate() error {
 	return nil
 }
 
-func getCellType(x, y int, circles []Circle) int {
-	for _, circle := range circles {
-		dx := x - circle.X
-		dy := y - circle.Y
+// noCirclesWarning возвращается в ответах распределения и эпох для карт без кругов
+const noCirclesWarning = "На карте нет кругов: все клетки белые (вне кругов)"
 
-		if dx == 0 && dy == 0 {
-			return 2 // зеленая (центр круга)
-		}
-		if dx*dx+dy*dy <= circle.Radius*circle.Radius {
-			return 1 // синяя (внутри круга)
-		}
+// circlesWarning возвращает предупреждение для карты без кругов
+func circlesWarning(circles []Circle) string {
+	if len(circles) == 0 {
+		return noCirclesWarning
 	}
-	return 0 // белая (вне кругов)
+	return ""
 }
 
-func createProbabilitySelector(probabilities []float64) []int {
-	selector := []int{}
-	for idx, p := range probabilities {
-		count := int(p * 50)
-		for i := 0; i < count; i++ {
-			selector = append(selector, idx)
-		}
-	}
-	return selector
+// cellTypeLegend расшифровывает коды типов клеток, возвращаемые getCellType
+var cellTypeLegend = map[string]string{
+	"0": "outside",
+	"1": "inside",
+	"2": "center",
+	"3": "wall",
 }
 
-func generateDistribution(cfg Config, circles []Circle, probabilities []float64) []Cell {
-	cells := []Cell{}
-	selector := createProbabilitySelector(probabilities)
-	if len(selector) == 0 {
-		return cells
+// ringRadius возвращает радиус кольца spawn: заданный в конфигурации
+// или наибольший, при котором spawn помещаются в карту
+func ringRadius(cfg Config) int {
+	if cfg.RingRadius > 0 {
+		return cfg.RingRadius
 	}
-
-	for y := 0; y < cfg.Height; y++ {
-		for x := 0; x < cfg.Width; x++ {
-			cellType := getCellType(x, y, circles)
-			var vals []int
-			switch cellType {
-			case 2: // зеленая - 0 чисел
-				continue
-			case 1: // синяя - 1 число
-				vals = []int{selector[rand.Intn(len(selector))]}
-			case 0: // белая - 1-2 числа
-				count := 1 + rand.Intn(2)
-				vals = make([]int, count)
-				for i := 0; i < count; i++ {
-					vals[i] = selector[rand.Intn(len(selector))]
-				}
-			}
-			if len(vals) > 0 {
-				cells = append(cells, Cell{X: x, Y: y, Vals: vals})
-			}
-		}
+	r := cfg.Width/2 - cfg.SpawnR - cfg.Border - 1
+	if h := cfg.Height/2 - cfg.SpawnR - cfg.Border - 1; h < r {
+		r = h
 	}
-	return cells
+	return r
 }
 
-func getNeighbors(x, y int, cfg Config) []struct{ X, Y int } {
-	directions := []struct{ dx, dy int }{
-		{-1, -1}, {-1, 0}, {-1, 1},
-		{0, -1}, {0, 1},
-		{1, -1}, {1, 0}, {1, 1},
+// ringSpawns возвращает spawn, равномерно расставленные по окружности радиуса
+// ringRadius вокруг центра карты; центры округляются до клеток
+func ringSpawns(cfg Config) []Circle {
+	cx, cy := cfg.Width/2, cfg.Height/2
+	radius := float64(ringRadius(cfg))
+	spawns := make([]Circle, 0, cfg.Spawns)
+	for i := 0; i < cfg.Spawns; i++ {
+		angle := 2 * math.Pi * float64(i) / float64(cfg.Spawns)
+		spawns = append(spawns, Circle{
+			X:      cx + int(math.Round(radius*math.Cos(angle))),
+			Y:      cy + int(math.Round(radius*math.Sin(angle))),
+			Radius: cfg.SpawnR,
+		})
 	}
-	neighbors := []struct{ X, Y int }{}
-	for _, d := range directions {
-		nx, ny := x+d.dx, y+d.dy
-		if nx >= 0 && nx < cfg.Width && ny >= 0 && ny < cfg.Height {
-			neighbors = append(neighbors, struct{ X, Y int }{nx, ny})
+	return spawns
+}
+
+// generateRing расставляет spawn по кольцу (ringSpawns), затем размещает
+// bedroom обычным способом.
+func (g *MapGenerator) generateRing() error {
+	for i, c := range ringSpawns(g.config) {
+		if !g.canPlaceCircle(c) {
+			return fmt.Errorf("не удалось разместить spawn %d на кольце радиуса %d", i+1, ringRadius(g.config))
 		}
+		g.addSpawn(c)
 	}
-	return neighbors
+	return g.placeBedrooms()
 }
 
-func moveNumbers(cfg Config, circles []Circle, cells []Cell, speeds []float64) []Cell {
-	if len(speeds) == 0 {
-		log.Println("⚠️  Скорости не установлены, числа не двигаются")
-		return cells
+// generateHex размещает круги в узлах гексагональной решетки с шагом
+// 2*radius + MaxGap (radius - наибольший из радиусов spawn и bedroom).
+// Узлы заполняются от центра карты: сначала spawn, затем bedroom.
+func (g *MapGenerator) generateHex() error {
+	radius := g.config.SpawnR
+	if g.config.BedroomR > radius {
+		radius = g.config.BedroomR
 	}
-
-	rand.Seed(time.Now().UnixNano())
-
-	// Создаем карту текущих позиций
-	state := make(map[string][]int)
-	for _, cell := range cells {
-		key := fmt.Sprintf("%d,%d", cell.X, cell.Y)
-		state[key] = append([]int{}, cell.Vals...)
+	spacing := float64(2*radius + g.config.MaxGap)
+	if spacing <= 0 {
+		return fmt.Errorf("шаг гексагональной решетки должен быть положительным")
 	}
 
-	// Создаем новую карту для результатов
-	newState := make(map[string][]int)
-
-	// Инициализируем новую карту пустыми слайсами
-	for y := 0; y < cfg.Height; y++ {
-		for x := 0; x < cfg.Width; x++ {
-			key := fmt.Sprintf("%d,%d", x, y)
-			newState[key] = []int{}
+	type point struct{ x, y int }
+	points := []point{}
+	rowHeight := spacing * math.Sqrt(3) / 2
+	for row := 0; ; row++ {
+		y := float64(radius) + float64(row)*rowHeight
+		if int(math.Round(y)) >= g.config.Height {
+			break
+		}
+		offset := 0.0
+		if row%2 == 1 {
+			offset = spacing / 2
+		}
+		for x := float64(radius) + offset; int(math.Round(x)) < g.config.Width; x += spacing {
+			points = append(points, point{int(math.Round(x)), int(math.Round(y))})
 		}
 	}
 
-	// Обрабатываем каждую клетку
-	for _, cell := range cells {
-		for _, val := range cell.Vals {
-			speedIdx := val
-			if speedIdx >= len(speeds) {
-				speedIdx = 0
-			}
-
-			speed := speeds[speedIdx]
-			if rand.Float64()*100 < speed {
-				// Пытаемся переместить число
-				moved := false
-				neighbors := getNeighbors(cell.X, cell.Y, cfg)
-
-				// Перемешиваем соседей для случайности
-				for i := len(neighbors) - 1; i > 0; i-- {
-					j := rand.Intn(i + 1)
-					neighbors[i], neighbors[j] = neighbors[j], neighbors[i]
-				}
-
-				for _, neigh := range neighbors {
-					neighborKey := fmt.Sprintf("%d,%d", neigh.X, neigh.Y)
-					neighborType := getCellType(neigh.X, neigh.Y, circles)
-					currentCount := len(newState[neighborKey])
-
-					canMove := false
-					switch neighborType {
-					case 0: // белая - максимум 2
-						canMove = currentCount < 2
-					case 1: // синяя - максимум 1  
-						canMove = currentCount < 1
-					case 2: // зеленая - недоступна
-						canMove = false
-					}
-
-					if canMove {
-						newState[neighborKey] = append(newState[neighborKey], val)
-						moved = true
-						break
-					}
-				}
-
-				if !moved {
-					// Число остается на прежнем месте
-					cellKey := fmt.Sprintf("%d,%d", cell.X, cell.Y)
-					newState[cellKey] = append(newState[cellKey], val)
-				}
-			} else {
-				// Число остается на прежнем месте
-				cellKey := fmt.Sprintf("%d,%d", cell.X, cell.Y)
-				newState[cellKey] = append(newState[cellKey], val)
+	cx, cy := g.config.Width/2, g.config.Height/2
+	sort.SliceStable(points, func(i, j int) bool {
+		di := (points[i].x-cx)*(points[i].x-cx) + (points[i].y-cy)*(points[i].y-cy)
+		dj := (points[j].x-cx)*(points[j].x-cx) + (points[j].y-cy)*(points[j].y-cy)
+		return di < dj
+	})
+
+	// nextCircle возвращает круг в ближайшем свободном узле решетки
+	next := 0
+	nextCircle := func(r int) (Circle, bool) {
+		for ; next < len(points); next++ {
+			c := Circle{X: points[next].x, Y: points[next].y, Radius: r}
+			if g.canPlaceCircle(c) {
+				next++
+				return c, true
 			}
 		}
+		return Circle{}, false
 	}
 
-	// Преобразуем обратно в Cell slice
-	result := []Cell{}
-	for y := 0; y < cfg.Height; y++ {
-		for x := 0; x < cfg.Width; x++ {
-			key := fmt.Sprintf("%d,%d", x, y)
-			if vals := newState[key]; len(vals) > 0 {
-				result = append(result, Cell{X: x, Y: y, Vals: vals})
-			}
+	for i := 0; i < g.config.Spawns; i++ {
+		c, ok := nextCircle(g.config.SpawnR)
+		if !ok {
+			return fmt.Errorf("не удалось разместить spawn %d: решетка заполнена", i+1)
 		}
+		g.addSpawn(c)
 	}
-	return result
+	for i := 0; i < g.config.Bedrooms; i++ {
+		c, ok := nextCircle(g.config.BedroomR)
+		if !ok {
+			return fmt.Errorf("не удалось разместить bedroom %d: решетка заполнена", i+1)
+		}
+		g.addBedroom(c)
+	}
+	return nil
 }
 
-// ФУНКЦИИ ДЛЯ РАБОТЫ С БД
-func saveCellsToDB(mapID int, cells []Cell) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return fmt.Errorf("начало транзакции: %v", err)
+// getCellType классифицирует клетку. Результат не зависит от порядка кругов:
+// центр любого круга (2) имеет приоритет над попаданием внутрь круга (1).
+// Центром считается диск радиуса cfg.CenterRadius вокруг центра круга.
+// Если кругов нет, все клетки карты считаются белыми (0).
+// Клетки рамки шириной cfg.Border - стена (3), она важнее кругов.
+func getCellType(x, y int, circles []Circle, cfg Config) int {
+	if inBorder(x, y, cfg) {
+		return 3 // стена (рамка карты)
 	}
-	defer tx.Rollback()
+	cellType := 0 // белая (вне кругов)
+	centerR2 := cfg.CenterRadius * cfg.CenterRadius
+	for _, circle := range circles {
+		dx := x - circle.X
+		dy := y - circle.Y
 
-	// Удаляем старые данные
-	_, err = tx.Exec("DELETE FROM map_cells WHERE map_id = ?", mapID)
-	if err != nil {
-		return fmt.Errorf("удаление старых клеток: %v", err)
+		if dx*dx+dy*dy <= centerR2 {
+			return 2 // зеленая (центр круга)
+		}
+		if dx*dx+dy*dy <= circle.Radius*circle.Radius {
+			cellType = 1 // синяя (внутри круга)
+		}
 	}
+	return cellType
+}
 
-	// ИСПРАВЛЕНО: используем cell_values вместо values
-	stmt, err := tx.Prepare("INSERT INTO map_cells (map_id, x, y, cell_values) VALUES (?, ?, ?, ?)")
-	if err != nil {
-		return fmt.Errorf("подготовка запроса: %v", err)
+// inBorder сообщает, лежит ли клетка в рамке карты шириной cfg.Border
+func inBorder(x, y int, cfg Config) bool {
+	b := cfg.Border
+	return b > 0 && (x < b || y < b || x >= cfg.Width-b || y >= cfg.Height-b)
+}
+
+// impassable сообщает, что в клетку этого типа числа не попадают: центр круга или стена
+func impassable(cellType int) bool {
+	return cellType == 2 || cellType == 3
+}
+
+// circleTypePriority - приоритет типа круга при перекрытии (меньше - важнее)
+func circleTypePriority(circleType string) int {
+	switch circleType {
+	case "spawn":
+		return 0
+	case "bedroom":
+		return 1
 	}
-	defer stmt.Close()
+	return 2
+}
 
-	for _, cell := range cells {
-		if len(cell.Vals) > 0 {
-			valsJSON, _ := json.Marshal(cell.Vals)
-			_, err = stmt.Exec(mapID, cell.X, cell.Y, string(valsJSON))
-			if err != nil {
-				return fmt.Errorf("вставка клетки (%d,%d): %v", cell.X, cell.Y, err)
+// owningCircle возвращает индекс круга, которому принадлежит клетка, или -1.
+// При перекрытии побеждает круг, в центре которого лежит клетка, затем spawn
+// над bedroom, затем меньший радиус, затем меньший индекс.
+func owningCircle(x, y int, circles []Circle, cfg Config) int {
+	best := -1
+	bestCenter := false
+	for idx, circle := range circles {
+		dx := x - circle.X
+		dy := y - circle.Y
+		if dx*dx+dy*dy > circle.Radius*circle.Radius {
+			continue
+		}
+		isCenter := dx*dx+dy*dy <= cfg.CenterRadius*cfg.CenterRadius
+		if best == -1 {
+			best, bestCenter = idx, isCenter
+			continue
+		}
+		cur := circles[best]
+		switch {
+		case isCenter != bestCenter:
+			if isCenter {
+				best, bestCenter = idx, isCenter
+			}
+		case circleTypePriority(circle.Type) != circleTypePriority(cur.Type):
+			if circleTypePriority(circle.Type) < circleTypePriority(cur.Type) {
+				best, bestCenter = idx, isCenter
 			}
+		case circle.Radius < cur.Radius:
+			best, bestCenter = idx, isCenter
 		}
 	}
+	return best
+}
 
-	err = tx.Commit()
-	if err != nil {
-		return fmt.Errorf("коммит транзакции: %v", err)
+const (
+	defaultSelectorResolution = 50
+	maxSelectorSize           = 1000000
+)
+
+// defaultInitialProbabilities используются для начального заполнения,
+// если у карты не заданы default_probabilities
+var defaultInitialProbabilities = []float64{90.0, 10.0}
+
+// initialProbabilities возвращает вероятности начального заполнения карты
+func initialProbabilities(cfg Config) []float64 {
+	if len(cfg.DefaultProbabilities) > 0 {
+		return cfg.DefaultProbabilities
 	}
+	return defaultInitialProbabilities
+}
 
+// validateProbabilities проверяет, что вероятности неотрицательны
+// и дают непустой селектор при заданном разрешении
+func validateProbabilities(probabilities []float64, resolution int) error {
+	if len(probabilities) == 0 {
+		return fmt.Errorf("массив вероятностей не может быть пустым")
+	}
+	for i, p := range probabilities {
+		if p < 0 || math.IsNaN(p) || math.IsInf(p, 0) {
+			return fmt.Errorf("вероятность [%d] должна быть неотрицательным числом, получено: %f", i, p)
+		}
+	}
+	if size := selectorSize(probabilities, resolution); size == 0 {
+		return fmt.Errorf("вероятности слишком малы для разрешения %d", resolution)
+	} else if size > maxSelectorSize {
+		return fmt.Errorf("слишком большой селектор: %d элементов (max %d)", size, maxSelectorSize)
+	}
 	return nil
 }
 
-func loadCellsFromDB(mapID int) ([]Cell, error) {
-	// ИСПРАВЛЕНО: используем cell_values и добавлено WHERE условие
-	rows, err := db.Query("SELECT x, y, cell_values FROM map_cells WHERE map_id = ?", mapID)
-	if err != nil {
-		return nil, fmt.Errorf("запрос клеток: %v", err)
+// selectorSize возвращает размер селектора для заданных вероятностей и разрешения
+func selectorSize(probabilities []float64, resolution int) int {
+	total := 0
+	for _, p := range probabilities {
+		if count := int(p * float64(resolution)); count > 0 {
+			total += count
+		}
 	}
-	defer rows.Close()
+	return total
+}
+
+func createProbabilitySelector(probabilities []float64, resolution int) []int {
+	selector := []int{}
+	for idx, p := range probabilities {
+		count := int(p * float64(resolution))
+		for i := 0; i < count; i++ {
+			selector = append(selector, idx)
+		}
+	}
+	return selector
+}
+
+// cellValues выбирает числа для клетки в зависимости от её типа
+func cellValues(rng *rand.Rand, cellType int, selector []int) []int {
+	switch cellType {
+	case 1: // синяя - 1 число
+		return []int{selector[rng.Intn(len(selector))]}
+	case 0: // белая - 1-2 числа
+		count := 1 + rng.Intn(2)
+		vals := make([]int, count)
+		for i := 0; i < count; i++ {
+			vals[i] = selector[rng.Intn(len(selector))]
+		}
+		return vals
+	}
+	return nil // зеленая - 0 чисел
+}
 
+// collapseProbabilities сворачивает все индексы начиная с maxValues в один
+// индекс "прочие" (равный maxValues). При maxValues <= 0 возвращает вход без изменений.
+func collapseProbabilities(probabilities []float64, maxValues int) []float64 {
+	if maxValues <= 0 || len(probabilities) <= maxValues+1 {
+		return probabilities
+	}
+	collapsed := append([]float64{}, probabilities[:maxValues]...)
+	other := 0.0
+	for _, p := range probabilities[maxValues:] {
+		other += p
+	}
+	return append(collapsed, other)
+}
+
+// DensityBand задает диапазон количества чисел в белой клетке в зависимости
+// от расстояния до ближайшего круга. MaxDistance <= 0 означает "без ограничения".
+type DensityBand struct {
+	MaxDistance float64 `json:"max_distance"`
+	MinCount    int     `json:"min_count"`
+	MaxCount    int     `json:"max_count"`
+}
+
+// validateDensityBands проверяет, что диапазоны не превышают вместимость белой клетки (2)
+func validateDensityBands(bands []DensityBand) error {
+	for i, b := range bands {
+		if b.MinCount < 0 || b.MaxCount > 2 || b.MinCount > b.MaxCount {
+			return fmt.Errorf("полоса [%d]: требуется 0 <= min_count <= max_count <= 2", i)
+		}
+	}
+	return nil
+}
+
+// distanceToNearestCircle возвращает расстояние от клетки до края ближайшего круга
+func distanceToNearestCircle(x, y int, circles []Circle) float64 {
+	best := math.Inf(1)
+	for _, c := range circles {
+		dist := math.Sqrt(float64((x-c.X)*(x-c.X)+(y-c.Y)*(y-c.Y))) - float64(c.Radius)
+		if dist < best {
+			best = dist
+		}
+	}
+	return best
+}
+
+// bandValueCount выбирает количество чисел для белой клетки по первой подходящей полосе.
+// Если ни одна полоса не подходит, используется равномерный выбор 1-2.
+func bandValueCount(rng *rand.Rand, distance float64, bands []DensityBand) int {
+	for _, b := range bands {
+		if b.MaxDistance <= 0 || distance <= b.MaxDistance {
+			return b.MinCount + rng.Intn(b.MaxCount-b.MinCount+1)
+		}
+	}
+	return 1 + rng.Intn(2)
+}
+
+func generateDistribution(cfg Config, circles []Circle, probabilities []float64, resolution int, bands []DensityBand) []Cell {
+	return generateDistributionWithRNG(newRNG(), cfg, circles, probabilities, resolution, bands)
+}
+
+// generateDistributionWithRNG - generateDistribution с заданным генератором:
+// при одинаковом зерне распределение совпадает полностью
+func generateDistributionWithRNG(rng *rand.Rand, cfg Config, circles []Circle, probabilities []float64, resolution int, bands []DensityBand) []Cell {
+	return generateTypedDistributionWithRNG(rng, cfg, circles, probabilities, nil, nil, resolution, bands)
+}
+
+// generateTypedDistribution распределяет числа, выбирая значения для синих и белых
+// клеток по отдельным вероятностям. Пустой вектор типа заменяется общим probabilities.
+func generateTypedDistribution(cfg Config, circles []Circle, probabilities, blue, white []float64, resolution int, bands []DensityBand) []Cell {
+	return generateTypedDistributionWithRNG(newRNG(), cfg, circles, probabilities, blue, white, resolution, bands)
+}
+
+// generateTypedDistributionWithRNG - generateTypedDistribution с заданным генератором
+func generateTypedDistributionWithRNG(rng *rand.Rand, cfg Config, circles []Circle, probabilities, blue, white []float64, resolution int, bands []DensityBand) []Cell {
 	cells := []Cell{}
-	for rows.Next() {
-		var x, y int
-		var valsJSON string
-		err = rows.Scan(&x, &y, &valsJSON)
-		if err != nil {
-			return nil, fmt.Errorf("чтение строки: %v", err)
+	if len(blue) == 0 {
+		blue = probabilities
+	}
+	if len(white) == 0 {
+		white = probabilities
+	}
+	selectors := map[int][]int{
+		0: createProbabilitySelector(white, resolution),
+		1: createProbabilitySelector(blue, resolution),
+	}
+
+	for y := 0; y < cfg.Height; y++ {
+		for x := 0; x < cfg.Width; x++ {
+			cellType := getCellType(x, y, circles, cfg)
+			selector := selectors[cellType]
+			if len(selector) == 0 {
+				continue
+			}
+			var vals []int
+			if cellType == 0 && len(bands) > 0 {
+				count := bandValueCount(rng, distanceToNearestCircle(x, y, circles), bands)
+				vals = make([]int, count)
+				for i := range vals {
+					vals[i] = selector[rng.Intn(len(selector))]
+				}
+			} else {
+				vals = cellValues(rng, cellType, selector)
+			}
+			vals = limitToCapacity(cfg, circles, x, y, vals)
+			if len(vals) > 0 {
+				cells = append(cells, Cell{X: x, Y: y, Vals: vals})
+			}
 		}
+	}
+	return cells
+}
 
-		var vals []int
-		err = json.Unmarshal([]byte(valsJSON), &vals)
-		if err != nil {
-			return nil, fmt.Errorf("парсинг values: %v", err)
+// FillState хранит прогресс постепенного заполнения карты (fill_rate)
+type FillState struct {
+	Probabilities []float64 `json:"probabilities"`
+	Resolution    int       `json:"resolution"`
+	Rate          float64   `json:"rate"`
+	Filled        int       `json:"filled"`
+	Target        int       `json:"target"`
+}
+
+// countFillable возвращает количество клеток, в которые можно поместить числа
+func countFillable(cfg Config, circles []Circle) int {
+	count := 0
+	for y := 0; y < cfg.Height; y++ {
+		for x := 0; x < cfg.Width; x++ {
+			if !impassable(getCellType(x, y, circles, cfg)) {
+				count++
+			}
 		}
+	}
+	return count
+}
 
-		cells = append(cells, Cell{X: x, Y: y, Vals: vals})
+// fillCells заполняет до limit случайных пустых клеток и возвращает
+// обновленный список клеток и количество заполненных
+func fillCells(cfg Config, circles []Circle, cells []Cell, state FillState, limit int) ([]Cell, int) {
+	selector := createProbabilitySelector(state.Probabilities, state.Resolution)
+	if len(selector) == 0 || limit <= 0 {
+		return cells, 0
 	}
 
-	return cells, nil
+	// Заполняется только слой 0: клетки других слоев место не занимают
+	occupied := make(map[string]bool)
+	for _, cell := range cells {
+		if cell.Layer == 0 {
+			occupied[fmt.Sprintf("%d,%d", cell.X, cell.Y)] = true
+		}
+	}
+
+	empty := []struct{ X, Y int }{}
+	for y := 0; y < cfg.Height; y++ {
+		for x := 0; x < cfg.Width; x++ {
+			if !impassable(getCellType(x, y, circles, cfg)) && !occupied[fmt.Sprintf("%d,%d", x, y)] {
+				empty = append(empty, struct{ X, Y int }{x, y})
+			}
+		}
+	}
+	rng := newRNG()
+	rng.Shuffle(len(empty), func(i, j int) { empty[i], empty[j] = empty[j], empty[i] })
+	if limit > len(empty) {
+		limit = len(empty)
+	}
+
+	for _, pos := range empty[:limit] {
+		vals := cellValues(rng, getCellType(pos.X, pos.Y, circles, cfg), selector)
+		if vals = limitToCapacity(cfg, circles, pos.X, pos.Y, vals); len(vals) > 0 {
+			cells = append(cells, Cell{X: pos.X, Y: pos.Y, Vals: vals})
+		}
+	}
+	return cells, limit
 }
 
-// НОВЫЕ ФУНКЦИИ ДЛЯ ИГРОКОВ
-func getSpawnPoints(circles []Circle) []Circle {
-	spawns := []Circle{}
-	for _, circle := range circles {
-		if circle.Type == "spawn" {
-			spawns = append(spawns, circle)
+// fillStep возвращает количество клеток, заполняемых за один шаг
+func fillStep(state FillState) int {
+	return int(math.Ceil(float64(state.Target) * state.Rate))
+}
+
+func getNeighbors(x, y int, cfg Config, neighborhood string) []struct{ X, Y int } {
+	directions := []struct{ dx, dy int }{
+		{-1, -1}, {-1, 0}, {-1, 1},
+		{0, -1}, {0, 1},
+		{1, -1}, {1, 0}, {1, 1},
+	}
+	if neighborhood == neighborhoodVonNeumann {
+		directions = []struct{ dx, dy int }{
+			{-1, 0}, {0, -1}, {0, 1}, {1, 0},
 		}
 	}
-	return spawns
+	neighbors := []struct{ X, Y int }{}
+	for _, d := range directions {
+		nx, ny := x+d.dx, y+d.dy
+		if nx >= 0 && nx < cfg.Width && ny >= 0 && ny < cfg.Height {
+			neighbors = append(neighbors, struct{ X, Y int }{nx, ny})
+		}
+	}
+	return neighbors
 }
 
-func getRandomSpawnPoint(spawns []Circle) (int, int) {
-	if len(spawns) == 0 {
-		return 0, 0 // fallback
+// newRNG создает независимый генератор случайных чисел. Зерно берется из
+// глобального источника, а не из текущего времени, поэтому генераторы,
+// созданные подряд, не коррелируют.
+func newRNG() *rand.Rand {
+	return rand.New(rand.NewSource(rand.Int63()))
+}
+
+// speedMultiplier возвращает множитель скорости для чисел в клетке (x, y)
+// по типу круга, которому она принадлежит. Вне кругов множитель равен 1.
+func speedMultiplier(cfg Config, circles []Circle, x, y int) float64 {
+	if len(cfg.SpeedMultipliers) == 0 {
+		return 1
+	}
+	idx := owningCircle(x, y, circles, cfg)
+	if idx < 0 {
+		return 1
 	}
+	if m, ok := cfg.SpeedMultipliers[circles[idx].Type]; ok {
+		return m
+	}
+	return 1
+}
 
-	spawn := spawns[rand.Intn(len(spawns))]
-	// Случайная позиция внутри spawn круга, но не в центре
-	angle := rand.Float64() * 2 * math.Pi
-	radius := 1 + rand.Float64()*float64(spawn.Radius-1)
+// MoveOptions - дополнительные параметры движения чисел за эпоху
+type MoveOptions struct {
+	// Cohesion - склонность числа переходить к соседям с такими же значениями
+	// (0 - случайное блуждание)
+	Cohesion float64
 
-	x := spawn.X + int(radius*math.Cos(angle))
-	y := spawn.Y + int(radius*math.Sin(angle))
+	// Immovable - значения, которые никогда не двигаются и остаются на месте
+	Immovable map[int]bool
 
-	return x, y
+	// WhenBlocked - поведение числа, когда все соседи заняты:
+	// "stay" (по умолчанию), "swap" или "wait-and-retry"
+	WhenBlocked string
+
+	// ValueInteractions - матрица [i][j]: множитель веса перехода значения i
+	// в клетку, где сейчас лежит значение j (отсутствующие элементы равны 1).
+	// Множитель меньше 1 уменьшает и вероятность движения: см. pickNeighbor.
+	ValueInteractions [][]float64
+
+	// RecordTransitions - собирать список перемещений чисел в MoveStats.Transitions
+	RecordTransitions bool
+
+	// DirectionWeights - веса направлений движения по смещению {dx, dy}.
+	// Если заданы, соседи в направлениях без веса не выбираются.
+	DirectionWeights map[[2]int]float64
+
+	// MaxSteps - при значении больше 1 скорость задает ожидаемое число шагов
+	// (speed/100 * MaxSteps), и число проходит случайный путь такой длины
+	MaxSteps int
+
+	// SortDirection - "lower": число переходит только в клетки, где все значения
+	// меньше его собственного, "higher" - где все больше; "" - без ограничения
+	SortDirection string
 }
 
-// Валидация данных
-func validateSpeeds(speeds []float64) error {
-	if len(speeds) == 0 {
-		return fmt.Errorf("массив скоростей не может быть пустым")
+// maxStepsPerMove - предельная длина пути числа за эпоху
+const maxStepsPerMove = 10
+
+// hopCount переводит скорость (в процентах) в число шагов за эпоху:
+// целая часть ожидаемого числа шагов плюс один шаг с вероятностью дробной части
+func hopCount(rng *rand.Rand, speed float64, maxSteps int) int {
+	expected := speed / 100 * float64(maxSteps)
+	if expected > float64(maxSteps) {
+		expected = float64(maxSteps)
 	}
-	for i, speed := range speeds {
-		if speed < 0 || speed > 100 {
-			return fmt.Errorf("скорость [%d] должна быть от 0 до 100, получено: %f", i, speed)
+	if expected <= 0 {
+		return 0
+	}
+	steps := int(expected)
+	if rng.Float64() < expected-float64(steps) {
+		steps++
+	}
+	return steps
+}
+
+const (
+	blockedStay      = "stay"
+	blockedSwap      = "swap"
+	blockedWaitRetry = "wait-and-retry"
+)
+
+const (
+	sortLower  = "lower"
+	sortHigher = "higher"
+)
+
+// sortAllowed сообщает, может ли число val перейти в клетку с числами occupants
+// при направлении сортировки direction. Пустая клетка подходит всегда.
+func sortAllowed(direction string, val int, occupants []int) bool {
+	for _, j := range occupants {
+		if (direction == sortLower && j >= val) || (direction == sortHigher && j <= val) {
+			return false
 		}
 	}
-	return nil
+	return true
 }
 
-func validateConfig(cfg Config) error {
-	if cfg.Width <= 0 || cfg.Height <= 0 {
-		return fmt.Errorf("размеры карты должны быть положительными")
+// directionOffsets сопоставляет названия направлений смещениям {dx, dy}
+// (ось y направлена вниз, "n" - вверх по карте)
+var directionOffsets = map[string][2]int{
+	"n": {0, -1}, "ne": {1, -1}, "e": {1, 0}, "se": {1, 1},
+	"s": {0, 1}, "sw": {-1, 1}, "w": {-1, 0}, "nw": {-1, -1},
+}
+
+// parseDirectionWeights проверяет веса направлений и переводит их в смещения
+func parseDirectionWeights(weights map[string]float64) (map[[2]int]float64, error) {
+	if len(weights) == 0 {
+		return nil, nil
 	}
-	if cfg.Width > 100 || cfg.Height > 100 {
-		return fmt.Errorf("размеры карты слишком большие (max 100x100)")
+	result := make(map[[2]int]float64, len(weights))
+	total := 0.0
+	for name, w := range weights {
+		offset, ok := directionOffsets[name]
+		if !ok {
+			return nil, fmt.Errorf("неизвестное направление %q (n, ne, e, se, s, sw, w, nw)", name)
+		}
+		if w < 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+			return nil, fmt.Errorf("вес направления %q должен быть неотрицательным", name)
+		}
+		result[offset] = w
+		total += w
 	}
-	if cfg.Spawns < 0 || cfg.Bedrooms < 0 {
-		return fmt.Errorf("количество spawn/bedroom не может быть отрицательным")
+	if total == 0 {
+		return nil, fmt.Errorf("все веса направлений равны нулю")
 	}
-	return nil
+	return result, nil
 }
 
-// HTTP Handlers
+// cohesionScore считает, сколько раз значение val встречается в клетке key
+// и в её окрестности
+func cohesionScore(key string, state map[string][]int, val int, cfg Config) int {
+	var x, y int
+	fmt.Sscanf(key, "%d,%d", &x, &y)
+	score := 0
+	count := func(k string) {
+		for _, v := range state[k] {
+			if v == val {
+				score++
+			}
+		}
+	}
+	count(key)
+	for _, n := range getNeighbors(x, y, cfg, cfg.Neighborhood) {
+		count(fmt.Sprintf("%d,%d", n.X, n.Y))
+	}
+	return score
+}
 
-func createMapHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
-		return
+// interactionFactor возвращает произведение множителей ValueInteractions[val][j]
+// по всем значениям j в клетке
+func interactionFactor(interactions [][]float64, val int, occupants []int) float64 {
+	if val >= len(interactions) {
+		return 1
+	}
+	row := interactions[val]
+	factor := 1.0
+	for _, j := range occupants {
+		if j < len(row) {
+			factor *= row[j]
+		}
 	}
+	return factor
+}
 
-	var req struct {
-		Name   string `json:"name"`
-		Config Config `json:"config"`
+// validateValueInteractions проверяет, что множители матрицы взаимодействий неотрицательны
+func validateValueInteractions(interactions [][]float64) error {
+	for i, row := range interactions {
+		for j, v := range row {
+			if v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+				return fmt.Errorf("элемент [%d][%d] должен быть неотрицательным числом", i, j)
+			}
+		}
 	}
+	return nil
+}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
-		return
+// pickNeighbor выбирает клетку среди кандидатов с весом
+// (1 + cohesion*score) * вес направления от клетки (x, y) * множитель взаимодействия
+// с числами в клетке на начало эпохи; при SortDirection клетки с неподходящими
+// значениями исключаются. Множитель взаимодействия меньше 1 работает как вероятность
+// отказа: недостающая часть веса клетки достается варианту «остаться на месте»,
+// и тогда возвращается сама клетка (x, y). Возвращает false, если у всех кандидатов
+// нулевой вес и оставаться тоже незачем.
+func pickNeighbor(rng *rand.Rand, x, y int, candidates []string, state map[string][]int, val int, cfg Config, opts MoveOptions) (string, bool) {
+	weights := make([]float64, len(candidates))
+	total, stayWeight := 0.0, 0.0
+	for i, key := range candidates {
+		if opts.SortDirection != "" && !sortAllowed(opts.SortDirection, val, state[key]) {
+			continue
+		}
+		weights[i] = 1 + opts.Cohesion*float64(cohesionScore(key, state, val, cfg))
+		if len(opts.DirectionWeights) > 0 {
+			var nx, ny int
+			fmt.Sscanf(key, "%d,%d", &nx, &ny)
+			weights[i] *= opts.DirectionWeights[[2]int{nx - x, ny - y}]
+		}
+		if len(opts.ValueInteractions) > 0 {
+			factor := interactionFactor(opts.ValueInteractions, val, state[key])
+			if factor < 1 {
+				stayWeight += weights[i] * (1 - factor)
+			}
+			weights[i] *= factor
+		}
+		total += weights[i]
+	}
+	if total+stayWeight == 0 {
+		return "", false
+	}
+	r := rng.Float64() * (total + stayWeight)
+	if r >= total {
+		return fmt.Sprintf("%d,%d", x, y), true
+	}
+	for i, w := range weights {
+		if r < w {
+			return candidates[i], true
+		}
+		r -= w
 	}
+	return candidates[len(candidates)-1], true
+}
 
-	if err := validateConfig(req.Config); err != nil {
-		http.Error(w, "Некорректная конфигурация: "+err.Error(), http.StatusBadRequest)
-		return
+// moveResult - итог попытки перемещения числа
+type moveResult int
+
+const (
+	moveDone    moveResult = iota // число перешло в другую клетку
+	moveStayed                    // число решило остаться на месте
+	moveBlocked                   // числу некуда идти
+)
+
+// MoveStats - статистика движения чисел за одну эпоху
+type MoveStats struct {
+	Moved     int             `json:"moved"`      // числа, перешедшие в соседнюю клетку
+	Stayed    int             `json:"stayed"`     // числа, оставшиеся на месте
+	Blocked   int             `json:"blocked"`    // из оставшихся: пытались двигаться, но не было свободных соседей
+	MoveRates map[int]float64 `json:"move_rates"` // доля переместившихся чисел по значению
+
+	// Переходы чисел между клетками (только при MoveOptions.RecordTransitions)
+	Transitions []Transition `json:"-"`
+
+	// Счетчики по значениям для объединения статистики нескольких слоев
+	movedByValue, totalByValue map[int]int
+}
+
+// Transition - перемещение числа value из клетки (from_x, from_y) в (to_x, to_y)
+type Transition struct {
+	FromX int `json:"from_x"`
+	FromY int `json:"from_y"`
+	ToX   int `json:"to_x"`
+	ToY   int `json:"to_y"`
+	Value int `json:"value"`
+	Layer int `json:"layer,omitempty"`
+}
+
+// newMoveStats подсчитывает итоговую статистику по счетчикам перемещений
+func newMoveStats(moved, total map[int]int, blocked int) MoveStats {
+	stats := MoveStats{Blocked: blocked, MoveRates: map[int]float64{}, movedByValue: moved, totalByValue: total}
+	for val, n := range total {
+		stats.Moved += moved[val]
+		stats.Stayed += n - moved[val]
+		stats.MoveRates[val] = float64(moved[val]) / float64(n)
+	}
+	return stats
+}
+
+// moveLayers выполняет эпоху движения для каждого слоя независимо: слой 0 двигается
+// со скоростями speeds, остальные - со своими из layerSpeeds. Слои без скоростей
+// остаются на месте. Статистика равна nil, если не двигался ни один слой.
+func moveLayers(rng *rand.Rand, cfg Config, circles []Circle, cells []Cell, speeds []float64, layerSpeeds map[int][]float64, opts MoveOptions) ([]Cell, *MoveStats) {
+	var stats *MoveStats
+	layers, byLayer := splitLayers(cells)
+	result := []Cell{}
+	for _, layer := range layers {
+		speedsForLayer := speeds
+		if layer > 0 {
+			speedsForLayer = layerSpeeds[layer]
+		}
+		if len(speedsForLayer) == 0 {
+			result = append(result, byLayer[layer]...)
+			continue
+		}
+
+		moved, moveStats := moveNumbers(rng, cfg, circles, byLayer[layer], speedsForLayer, opts)
+		result = append(result, setLayer(moved, layer)...)
+		for i := range moveStats.Transitions {
+			moveStats.Transitions[i].Layer = layer
+		}
+		if stats != nil {
+			moveStats = mergeMoveStats(*stats, moveStats)
+		}
+		stats = &moveStats
+	}
+	return result, stats
+}
+
+// mergeMoveStats объединяет статистику движения двух слоев
+func mergeMoveStats(a, b MoveStats) MoveStats {
+	moved := make(map[int]int)
+	total := make(map[int]int)
+	for _, s := range []MoveStats{a, b} {
+		for val, n := range s.movedByValue {
+			moved[val] += n
+		}
+		for val, n := range s.totalByValue {
+			total[val] += n
+		}
+	}
+	stats := newMoveStats(moved, total, a.Blocked+b.Blocked)
+	stats.Transitions = append(append([]Transition{}, a.Transitions...), b.Transitions...)
+	return stats
+}
+
+// moveNumbers выполняет одну эпоху движения. Вся случайность берется из rng,
+// поэтому при одинаковом зерне результат воспроизводим.
+func moveNumbers(rng *rand.Rand, cfg Config, circles []Circle, cells []Cell, speeds []float64, opts MoveOptions) ([]Cell, MoveStats) {
+	movedByValue := make(map[int]int)
+	totalByValue := make(map[int]int)
+	blocked := 0
+
+	if len(speeds) == 0 {
+		log.Println("⚠️  Скорости не установлены, числа не двигаются")
+		for _, cell := range cells {
+			for _, val := range cell.Vals {
+				totalByValue[val]++
+			}
+		}
+		return cells, newMoveStats(movedByValue, totalByValue, blocked)
+	}
+
+	// Создаем карту текущих позиций
+	state := make(map[string][]int)
+	for _, cell := range cells {
+		key := fmt.Sprintf("%d,%d", cell.X, cell.Y)
+		state[key] = append([]int{}, cell.Vals...)
+	}
+
+	// Создаем новую карту для результатов (возраст чисел переносится вместе с ними)
+	newState := make(map[string][]int)
+	newAges := make(map[string][]int)
+	trackAges := false
+	for _, cell := range cells {
+		if len(cell.Ages) > 0 {
+			trackAges = true
+			break
+		}
+	}
+
+	// Инициализируем новую карту пустыми слайсами
+	for y := 0; y < cfg.Height; y++ {
+		for x := 0; x < cfg.Width; x++ {
+			key := fmt.Sprintf("%d,%d", x, y)
+			newState[key] = []int{}
+		}
+	}
+
+	transitions := []Transition{}
+	// record запоминает перемещение числа в клетку с ключом key
+	record := func(x, y int, key string, val int) {
+		if !opts.RecordTransitions {
+			return
+		}
+		t := Transition{FromX: x, FromY: y, Value: val}
+		fmt.Sscanf(key, "%d,%d", &t.ToX, &t.ToY)
+		transitions = append(transitions, t)
+	}
+
+	// stay оставляет число в клетке (x, y)
+	stay := func(x, y, val, age int) {
+		key := fmt.Sprintf("%d,%d", x, y)
+		newState[key] = append(newState[key], val)
+		newAges[key] = append(newAges[key], age)
+	}
+
+	// shuffledNeighbors возвращает соседей клетки в случайном порядке
+	shuffledNeighbors := func(x, y int) []struct{ X, Y int } {
+		neighbors := getNeighbors(x, y, cfg, cfg.Neighborhood)
+		for i := len(neighbors) - 1; i > 0; i-- {
+			j := rng.Intn(i + 1)
+			neighbors[i], neighbors[j] = neighbors[j], neighbors[i]
+		}
+		return neighbors
+	}
+
+	// pickTarget выбирает соседнюю клетку со свободным местом для шага числа
+	pickTarget := func(x, y, val int) (string, bool) {
+		// Отбираем соседей, способных принять число
+		candidates := []string{}
+		for _, neigh := range shuffledNeighbors(x, y) {
+			neighborKey := fmt.Sprintf("%d,%d", neigh.X, neigh.Y)
+			capacity := cellCapacityAt(cfg, circles, neigh.X, neigh.Y)
+			if len(newState[neighborKey]) < capacity {
+				candidates = append(candidates, neighborKey)
+			}
+		}
+		if len(candidates) == 0 {
+			return "", false
+		}
+
+		if opts.Cohesion > 0 || len(opts.DirectionWeights) > 0 || len(opts.ValueInteractions) > 0 || opts.SortDirection != "" {
+			return pickNeighbor(rng, x, y, candidates, state, val, cfg, opts)
+		}
+		return candidates[0], true
+	}
+
+	// tryMove перемещает число на steps шагов по соседним клеткам со свободным местом.
+	// Путь обрывается, если на очередном шаге некуда идти или число отказалось от шага.
+	tryMove := func(x, y, val, age, steps int) moveResult {
+		target := ""
+		declined := false
+		cx, cy := x, y
+		for i := 0; i < steps; i++ {
+			next, ok := pickTarget(cx, cy, val)
+			if !ok {
+				break
+			}
+			if next == fmt.Sprintf("%d,%d", cx, cy) {
+				declined = true
+				break
+			}
+			target = next
+			fmt.Sscanf(next, "%d,%d", &cx, &cy)
+		}
+		if target == "" {
+			if declined {
+				stay(x, y, val, age)
+				return moveStayed
+			}
+			return moveBlocked
+		}
+		if cx == x && cy == y {
+			// Путь вернулся в исходную клетку: число никуда не переместилось
+			stay(x, y, val, age)
+			return moveStayed
+		}
+		newState[target] = append(newState[target], val)
+		newAges[target] = append(newAges[target], age)
+		record(x, y, target, val)
+		return moveDone
+	}
+
+	// trySwap меняет число местами со случайным числом соседней клетки.
+	// Количество чисел в обеих клетках не меняется.
+	// Неподвижные значения соседа в обмене не участвуют, а направление сортировки
+	// проверяется так же, как при обычном переходе числа в соседнюю клетку.
+	trySwap := func(x, y, val, age int) bool {
+		for _, neigh := range shuffledNeighbors(x, y) {
+			neighborKey := fmt.Sprintf("%d,%d", neigh.X, neigh.Y)
+			if impassable(getCellType(neigh.X, neigh.Y, circles, cfg)) || len(newState[neighborKey]) == 0 {
+				continue
+			}
+			if opts.SortDirection != "" && !sortAllowed(opts.SortDirection, val, state[neighborKey]) {
+				continue
+			}
+			movable := []int{}
+			for j, other := range newState[neighborKey] {
+				if !opts.Immovable[other] {
+					movable = append(movable, j)
+				}
+			}
+			if len(movable) == 0 {
+				continue
+			}
+			j := movable[rng.Intn(len(movable))]
+			other, otherAge := newState[neighborKey][j], newAges[neighborKey][j]
+			newState[neighborKey][j], newAges[neighborKey][j] = val, age
+			stay(x, y, other, otherAge)
+			record(x, y, neighborKey, val)
+			record(neigh.X, neigh.Y, fmt.Sprintf("%d,%d", x, y), other)
+			return true
+		}
+		return false
+	}
+
+	// Числа, ожидающие повторной попытки после хода остальных (wait-and-retry)
+	type waitingNumber struct{ x, y, val, age, steps int }
+	waiting := []waitingNumber{}
+
+	// Обрабатываем каждую клетку
+	for _, cell := range cells {
+		multiplier := speedMultiplier(cfg, circles, cell.X, cell.Y)
+		for vi, val := range cell.Vals {
+			totalByValue[val]++
+			age := cell.age(vi)
+			speedIdx := val
+			if speedIdx >= len(speeds) {
+				speedIdx = 0
+			}
+
+			speed := speeds[speedIdx] * multiplier
+			steps := 0
+			if !opts.Immovable[val] {
+				if opts.MaxSteps > 1 {
+					steps = hopCount(rng, speed, opts.MaxSteps)
+				} else if rng.Float64()*100 < speed {
+					steps = 1
+				}
+			}
+			if steps == 0 {
+				// Число остается на прежнем месте
+				stay(cell.X, cell.Y, val, age)
+				continue
+			}
+
+			// Пытаемся переместить число
+			switch tryMove(cell.X, cell.Y, val, age, steps) {
+			case moveDone:
+				movedByValue[val]++
+				continue
+			case moveStayed:
+				continue
+			}
+
+			// Все соседи заняты
+			switch opts.WhenBlocked {
+			case blockedSwap:
+				if trySwap(cell.X, cell.Y, val, age) {
+					movedByValue[val]++
+					continue
+				}
+			case blockedWaitRetry:
+				waiting = append(waiting, waitingNumber{cell.X, cell.Y, val, age, steps})
+				continue
+			}
+			blocked++
+			stay(cell.X, cell.Y, val, age)
+		}
+	}
+
+	// Повторная попытка для ожидавших чисел: за эпоху могли освободиться места
+	for _, n := range waiting {
+		switch tryMove(n.x, n.y, n.val, n.age, n.steps) {
+		case moveDone:
+			movedByValue[n.val]++
+			continue
+		case moveStayed:
+			continue
+		}
+		blocked++
+		stay(n.x, n.y, n.val, n.age)
+	}
+
+	// Преобразуем обратно в Cell slice
+	result := []Cell{}
+	for y := 0; y < cfg.Height; y++ {
+		for x := 0; x < cfg.Width; x++ {
+			key := fmt.Sprintf("%d,%d", x, y)
+			if vals := newState[key]; len(vals) > 0 {
+				cell := Cell{X: x, Y: y, Vals: vals}
+				if trackAges {
+					cell.Ages = newAges[key]
+				}
+				result = append(result, cell)
+			}
+		}
+	}
+	stats := newMoveStats(movedByValue, totalByValue, blocked)
+	if opts.RecordTransitions {
+		stats.Transitions = transitions
+	}
+	return result, stats
+}
+
+// ageCells увеличивает возраст всех чисел на 1 и удаляет числа старше maxAge.
+// Возвращает новые клетки и количество умерших чисел.
+func ageCells(cells []Cell, maxAge int) ([]Cell, int) {
+	result := []Cell{}
+	died := 0
+	for _, cell := range cells {
+		aged := Cell{X: cell.X, Y: cell.Y, Vals: []int{}, Ages: []int{}, Layer: cell.Layer}
+		for i, val := range cell.Vals {
+			age := cell.age(i) + 1
+			if age > maxAge {
+				died++
+				continue
+			}
+			aged.Vals = append(aged.Vals, val)
+			aged.Ages = append(aged.Ages, age)
+		}
+		if len(aged.Vals) > 0 {
+			result = append(result, aged)
+		}
+	}
+	return result, died
+}
+
+// decayCells независимо удаляет каждое число с вероятностью decay.
+// Возвращает новые клетки и количество удаленных чисел.
+func decayCells(rng *rand.Rand, cells []Cell, decay float64) ([]Cell, int) {
+	result := []Cell{}
+	decayed := 0
+	for _, cell := range cells {
+		kept := Cell{X: cell.X, Y: cell.Y, Vals: []int{}, Layer: cell.Layer}
+		for i, val := range cell.Vals {
+			if rng.Float64() < decay {
+				decayed++
+				continue
+			}
+			kept.Vals = append(kept.Vals, val)
+			if cell.Ages != nil {
+				kept.Ages = append(kept.Ages, cell.age(i))
+			}
+		}
+		if len(kept.Vals) > 0 {
+			result = append(result, kept)
+		}
+	}
+	return result, decayed
+}
+
+// ФУНКЦИИ ДЛЯ РАБОТЫ С БД
+
+// orphanTables - таблицы, строки которых ссылаются на карту через map_id
+var orphanTables = []string{"map_cells", "map_history", "map_annotations"}
+
+// cleanupOrphans удаляет строки, ссылающиеся на несуществующие карты.
+// Возвращает количество удаленных строк по таблицам.
+func cleanupOrphans() (map[string]int64, error) {
+	removed := make(map[string]int64)
+	for _, table := range orphanTables {
+		res, err := db.Exec("DELETE FROM " + table + " WHERE map_id NOT IN (SELECT id FROM maps)")
+		if err != nil {
+			return removed, fmt.Errorf("очистка %s: %v", table, err)
+		}
+		n, _ := res.RowsAffected()
+		removed[table] = n
+	}
+	return removed, nil
+}
+
+// loadMapGeometry загружает конфигурацию и круги карты.
+// Если карта не найдена или мягко удалена, возвращает sql.ErrNoRows.
+func loadMapGeometry(mapID int) (Config, []Circle, error) {
+	var cfg Config
+	var circles []Circle
+	var configStr, circlesStr string
+	err := db.QueryRow("SELECT config, circles FROM maps WHERE id = ? AND deleted_at IS NULL", mapID).
+		Scan(&configStr, &circlesStr)
+	if err != nil {
+		return cfg, nil, err
+	}
+	if err := json.Unmarshal([]byte(configStr), &cfg); err != nil {
+		return cfg, nil, fmt.Errorf("парсинг config: %v", err)
+	}
+	if err := json.Unmarshal([]byte(circlesStr), &circles); err != nil {
+		return cfg, nil, fmt.Errorf("парсинг circles: %v", err)
+	}
+	if circles == nil {
+		circles = []Circle{}
+	}
+	return cfg, circles, nil
+}
+
+func saveCellsToDB(mapID int, cells []Cell) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("начало транзакции: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := saveCellsTx(tx, mapID, cells); err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("коммит транзакции: %v", err)
+	}
+
+	return nil
+}
+
+// compressCells включает gzip-сжатие снимков истории эпох (map_history.cells)
+// при сохранении (флаг -compress-cells). Снимок содержит все клетки карты, поэтому
+// сжатие заметно уменьшает его; строки map_cells слишком короткие и не сжимаются.
+var compressCells bool
+
+// compressedPrefix помечает сжатые данные: "gz:" + base64(gzip(JSON)).
+// Несжатые данные хранятся как обычный JSON, поэтому старые строки читаются без изменений.
+const compressedPrefix = "gz:"
+
+// compressJSON сжимает сериализованные данные при включенном -compress-cells.
+// Сжатая форма используется, только если она короче JSON.
+func compressJSON(data []byte) string {
+	if !compressCells {
+		return string(data)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		return string(data)
+	}
+	encoded := compressedPrefix + base64.StdEncoding.EncodeToString(buf.Bytes())
+	if len(encoded) >= len(data) {
+		return string(data)
+	}
+	return encoded
+}
+
+// decompressJSON возвращает JSON из сжатой или обычной формы
+func decompressJSON(stored string) ([]byte, error) {
+	if !strings.HasPrefix(stored, compressedPrefix) {
+		return []byte(stored), nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, compressedPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("base64: %v", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("gzip: %v", err)
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("gzip: %v", err)
+	}
+	return data, nil
+}
+
+// encodeCellValues сериализует числа клетки для колонки cell_values
+func encodeCellValues(vals []int) string {
+	valsJSON, _ := json.Marshal(vals)
+	return string(valsJSON)
+}
+
+// decodeCellValues разбирает cell_values; сжатые значения могли остаться
+// от версий, сжимавших каждую клетку
+func decodeCellValues(stored string) ([]int, error) {
+	data, err := decompressJSON(stored)
+	if err != nil {
+		return nil, err
+	}
+	var vals []int
+	if err := json.Unmarshal(data, &vals); err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
+// saveCellsTx полностью перезаписывает клетки карты в рамках транзакции
+func saveCellsTx(tx *sql.Tx, mapID int, cells []Cell) error {
+	// Удаляем старые данные
+	_, err := tx.Exec("DELETE FROM map_cells WHERE map_id = ?", mapID)
+	if err != nil {
+		return fmt.Errorf("удаление старых клеток: %v", err)
+	}
+
+	// ИСПРАВЛЕНО: используем cell_values вместо values
+	stmt, err := tx.Prepare("INSERT INTO map_cells (map_id, x, y, layer, cell_values, cell_ages) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("подготовка запроса: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, cell := range cells {
+		if len(cell.Vals) > 0 {
+			_, err = stmt.Exec(mapID, cell.X, cell.Y, cell.Layer, encodeCellValues(cell.Vals), cell.agesJSON())
+			if err != nil {
+				return fmt.Errorf("вставка клетки (%d,%d): %v", cell.X, cell.Y, err)
+			}
+		}
+	}
+	return nil
+}
+
+// saveCellsDiffToDB сохраняет только изменившиеся клетки: сравнивает новое
+// состояние с сохраненным и выполняет точечные INSERT/UPDATE/DELETE.
+// Возвращает количество вставленных, обновленных и удаленных строк.
+func saveCellsDiffToDB(mapID int, cells []Cell) (inserted, updated, deleted int, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("начало транзакции: %v", err)
+	}
+	defer tx.Rollback()
+
+	if inserted, updated, deleted, err = saveCellsDiffTx(tx, mapID, cells); err != nil {
+		return 0, 0, 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, 0, 0, fmt.Errorf("коммит транзакции: %v", err)
+	}
+	return inserted, updated, deleted, nil
+}
+
+// saveCellsDiffTx - saveCellsDiffToDB внутри уже открытой транзакции
+func saveCellsDiffTx(tx *sql.Tx, mapID int, cells []Cell) (inserted, updated, deleted int, err error) {
+	type storedCell struct {
+		id   int64
+		vals string
+		ages string
+	}
+	stored := make(map[string]storedCell)
+	rows, err := tx.Query("SELECT id, x, y, layer, cell_values, cell_ages FROM map_cells WHERE map_id = ?", mapID)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("запрос клеток: %v", err)
+	}
+	for rows.Next() {
+		var id int64
+		var x, y, layer int
+		var vals, ages string
+		if err := rows.Scan(&id, &x, &y, &layer, &vals, &ages); err != nil {
+			rows.Close()
+			return 0, 0, 0, fmt.Errorf("чтение строки: %v", err)
+		}
+		stored[fmt.Sprintf("%d,%d,%d", x, y, layer)] = storedCell{id, vals, ages}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, 0, fmt.Errorf("чтение клеток: %v", err)
+	}
+
+	for _, cell := range cells {
+		if len(cell.Vals) == 0 {
+			continue
+		}
+		key := fmt.Sprintf("%d,%d,%d", cell.X, cell.Y, cell.Layer)
+		vals := encodeCellValues(cell.Vals)
+		agesJSON := cell.agesJSON()
+		old, exists := stored[key]
+		delete(stored, key)
+
+		switch {
+		case exists && old.vals == vals && old.ages == agesJSON:
+			continue
+		case exists:
+			_, err = tx.Exec("UPDATE map_cells SET cell_values = ?, cell_ages = ? WHERE id = ?",
+				vals, agesJSON, old.id)
+			if err != nil {
+				return 0, 0, 0, fmt.Errorf("обновление клетки (%d,%d): %v", cell.X, cell.Y, err)
+			}
+			updated++
+		default:
+			_, err = tx.Exec("INSERT INTO map_cells (map_id, x, y, layer, cell_values, cell_ages) VALUES (?, ?, ?, ?, ?, ?)",
+				mapID, cell.X, cell.Y, cell.Layer, vals, agesJSON)
+			if err != nil {
+				return 0, 0, 0, fmt.Errorf("вставка клетки (%d,%d): %v", cell.X, cell.Y, err)
+			}
+			inserted++
+		}
+	}
+
+	// Оставшиеся клетки опустели
+	for key, old := range stored {
+		if _, err = tx.Exec("DELETE FROM map_cells WHERE id = ?", old.id); err != nil {
+			return 0, 0, 0, fmt.Errorf("удаление клетки %s: %v", key, err)
+		}
+		deleted++
+	}
+	return inserted, updated, deleted, nil
+}
+
+// loadMap загружает карту целиком (без клеток).
+// Если карта не найдена или мягко удалена, возвращает sql.ErrNoRows.
+func loadMap(mapID int) (Map, error) {
+	var m Map
+	var configStr, circlesStr string
+	var speedsStr sql.NullString
+	var epoch sql.NullInt64
+	err := db.QueryRow("SELECT id, name, config, circles, speeds, epoch, created_at FROM maps WHERE id = ? AND deleted_at IS NULL", mapID).
+		Scan(&m.ID, &m.Name, &configStr, &circlesStr, &speedsStr, &epoch, &m.Created)
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal([]byte(configStr), &m.Config); err != nil {
+		return m, fmt.Errorf("парсинг config: %v", err)
+	}
+	if err := json.Unmarshal([]byte(circlesStr), &m.Circles); err != nil {
+		return m, fmt.Errorf("парсинг circles: %v", err)
+	}
+	// Пустые списки отдаются как [], а не null
+	if m.Circles == nil {
+		m.Circles = []Circle{}
+	}
+	if speedsStr.Valid && speedsStr.String != "" && speedsStr.String != "[]" {
+		if err := json.Unmarshal([]byte(speedsStr.String), &m.Speeds); err != nil {
+			return m, fmt.Errorf("парсинг speeds: %v", err)
+		}
+	}
+	if m.Speeds == nil {
+		m.Speeds = []float64{}
+	}
+	m.Epoch = int(epoch.Int64)
+	return m, nil
+}
+
+// idempotencyTTL - время жизни ключа идемпотентности
+const idempotencyTTL = 24 * time.Hour
+
+// lookupIdempotencyKey возвращает ID карты, созданной с этим ключом, если ключ не истек
+func lookupIdempotencyKey(key string) (int, bool, error) {
+	cutoff := time.Now().Add(-idempotencyTTL).Unix()
+	if _, err := db.Exec("DELETE FROM idempotency_keys WHERE created_at < ?", cutoff); err != nil {
+		return 0, false, fmt.Errorf("очистка ключей: %v", err)
+	}
+	var mapID int
+	err := db.QueryRow("SELECT map_id FROM idempotency_keys WHERE key = ?", key).Scan(&mapID)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("поиск ключа: %v", err)
+	}
+	return mapID, true, nil
+}
+
+// execer - общий интерфейс *sql.DB и *sql.Tx для выполнения запросов
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// queryer - общий интерфейс *sql.DB и *sql.Tx для чтения строк
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// HistoryFrame - сохраненное состояние клеток на определенной эпохе
+type HistoryFrame struct {
+	Epoch int    `json:"epoch"`
+	Cells []Cell `json:"cells"`
+}
+
+// saveHistorySnapshot сохраняет снимок клеток для эпохи (перезаписывая существующий)
+func saveHistorySnapshot(ex execer, mapID, epoch int, cells []Cell) error {
+	cellsJSON, _ := json.Marshal(cells)
+	_, err := ex.Exec("INSERT OR REPLACE INTO map_history (map_id, epoch, cells) VALUES (?, ?, ?)",
+		mapID, epoch, compressJSON(cellsJSON))
+	if err != nil {
+		return fmt.Errorf("сохранение истории эпохи %d: %v", epoch, err)
+	}
+	return nil
+}
+
+// loadHistory загружает снимки эпох из диапазона [from, to] по возрастанию эпохи
+func loadHistory(mapID, from, to int) ([]HistoryFrame, error) {
+	rows, err := db.Query("SELECT epoch, cells FROM map_history WHERE map_id = ? AND epoch >= ? AND epoch <= ? ORDER BY epoch",
+		mapID, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("запрос истории: %v", err)
+	}
+	return scanHistory(rows)
+}
+
+// loadRecentHistory загружает снимки последних count эпох одним запросом,
+// отсортированные по возрастанию эпохи
+func loadRecentHistory(mapID, count int) ([]HistoryFrame, error) {
+	rows, err := db.Query(`SELECT epoch, cells FROM (
+		SELECT epoch, cells FROM map_history WHERE map_id = ? ORDER BY epoch DESC LIMIT ?
+	) ORDER BY epoch`, mapID, count)
+	if err != nil {
+		return nil, fmt.Errorf("запрос истории: %v", err)
+	}
+	return scanHistory(rows)
+}
+
+// scanHistory читает снимки эпох из результата запроса (epoch, cells) и закрывает его
+func scanHistory(rows *sql.Rows) ([]HistoryFrame, error) {
+	defer rows.Close()
+
+	frames := []HistoryFrame{}
+	for rows.Next() {
+		var frame HistoryFrame
+		var stored string
+		if err := rows.Scan(&frame.Epoch, &stored); err != nil {
+			return nil, fmt.Errorf("чтение истории: %v", err)
+		}
+		cellsJSON, err := decompressJSON(stored)
+		if err != nil {
+			return nil, fmt.Errorf("распаковка истории эпохи %d: %v", frame.Epoch, err)
+		}
+		if err := json.Unmarshal(cellsJSON, &frame.Cells); err != nil {
+			return nil, fmt.Errorf("парсинг истории эпохи %d: %v", frame.Epoch, err)
+		}
+		if frame.Cells == nil {
+			frame.Cells = []Cell{}
+		}
+		frames = append(frames, frame)
+	}
+	return frames, rows.Err()
+}
+
+// loadCellsFromDB загружает клетки карты, пропуская строки с поврежденным JSON
+func loadCellsFromDB(mapID int) ([]Cell, error) {
+	cells, _, err := loadCells(db, mapID, false)
+	return cells, err
+}
+
+// loadCellsForUpdate загружает клетки карты для изменяющих путей. Поврежденные
+// строки здесь не пропускаются: следующее сохранение перезаписало бы клетки карты
+// и удалило их, поэтому при любой поврежденной строке возвращается ошибка.
+// q - db или транзакция, в которой клетки затем перезаписываются.
+func loadCellsForUpdate(q queryer, mapID int) ([]Cell, error) {
+	cells, skipped, err := loadCells(q, mapID, false)
+	if err != nil {
+		return nil, err
+	}
+	if skipped > 0 {
+		return nil, fmt.Errorf("поврежденных клеток: %d; изменение отменено, чтобы не удалить их "+
+			"(подробности в логе карты и в GET /api/maps/%d/cells?strict=true)", skipped, mapID)
+	}
+	return cells, nil
+}
+
+// loadCells загружает клетки карты. В нестрогом режиме строки, которые не
+// удалось разобрать, записываются в лог и пропускаются; их количество
+// возвращается вторым значением. В строгом режиме первая такая строка - ошибка.
+func loadCells(q queryer, mapID int, strict bool) ([]Cell, int, error) {
+	// ИСПРАВЛЕНО: используем cell_values и добавлено WHERE условие
+	rows, err := q.Query("SELECT x, y, layer, cell_values, cell_ages FROM map_cells WHERE map_id = ?", mapID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("запрос клеток: %v", err)
+	}
+	defer rows.Close()
+
+	cells := []Cell{}
+	skipped := 0
+	for rows.Next() {
+		var x, y, layer int
+		var valsJSON, agesJSON string
+		err = rows.Scan(&x, &y, &layer, &valsJSON, &agesJSON)
+		if err != nil {
+			return nil, 0, fmt.Errorf("чтение строки: %v", err)
+		}
+
+		var vals, ages []int
+		vals, err = decodeCellValues(valsJSON)
+		if err == nil && agesJSON != "" {
+			err = json.Unmarshal([]byte(agesJSON), &ages)
+		}
+		if err != nil {
+			if strict {
+				return nil, 0, fmt.Errorf("парсинг клетки (%d,%d): %v", x, y, err)
+			}
+			mapLogf(mapID, "⚠️  Карта %d: пропущена поврежденная клетка (%d,%d): %v", mapID, x, y, err)
+			skipped++
+			continue
+		}
+
+		cells = append(cells, Cell{X: x, Y: y, Vals: vals, Ages: ages, Layer: layer})
+	}
+
+	return cells, skipped, rows.Err()
+}
+
+// НОВЫЕ ФУНКЦИИ ДЛЯ ИГРОКОВ
+func getSpawnPoints(circles []Circle) []Circle {
+	spawns := []Circle{}
+	for _, circle := range circles {
+		if circle.Type == "spawn" {
+			spawns = append(spawns, circle)
+		}
+	}
+	return spawns
+}
+
+func getRandomSpawnPoint(spawns []Circle) (int, int) {
+	if len(spawns) == 0 {
+		return 0, 0 // fallback
+	}
+
+	spawn := spawns[rand.Intn(len(spawns))]
+	// Случайная позиция внутри spawn круга, но не в центре
+	angle := rand.Float64() * 2 * math.Pi
+	radius := 1 + rand.Float64()*float64(spawn.Radius-1)
+
+	x := spawn.X + int(radius*math.Cos(angle))
+	y := spawn.Y + int(radius*math.Sin(angle))
+
+	return x, y
+}
+
+const (
+	defaultCoverageRetries = 5
+	maxCoverageRetries     = 50
+)
+
+// computeCoverage возвращает долю клеток карты, лежащих внутри кругов
+func computeCoverage(cfg Config, circles []Circle) float64 {
+	total := cfg.Width * cfg.Height
+	if total == 0 {
+		return 0
+	}
+	covered := 0
+	for y := 0; y < cfg.Height; y++ {
+		for x := 0; x < cfg.Width; x++ {
+			if t := getCellType(x, y, circles, cfg); t == 1 || t == 2 {
+				covered++
+			}
+		}
+	}
+	return float64(covered) / float64(total)
+}
+
+// meanNearestDistance возвращает среднее расстояние от центров кругов from
+// до ближайшего центра среди to (исключая сам круг при from == to)
+func meanNearestDistance(from, to []Circle, same bool) float64 {
+	total, count := 0.0, 0
+	for i, a := range from {
+		best := math.Inf(1)
+		for j, b := range to {
+			if same && i == j {
+				continue
+			}
+			if d := math.Hypot(float64(a.X-b.X), float64(a.Y-b.Y)); d < best {
+				best = d
+			}
+		}
+		if !math.IsInf(best, 1) {
+			total += best
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return total / float64(count)
+}
+
+// computeTerritories возвращает для каждой клетки индекс ближайшего центра круга
+// (разбиение Вороного). Если кругов нет, все клетки получают -1.
+func computeTerritories(cfg Config, circles []Circle) [][]int {
+	grid := make([][]int, cfg.Height)
+	for y := 0; y < cfg.Height; y++ {
+		grid[y] = make([]int, cfg.Width)
+		for x := 0; x < cfg.Width; x++ {
+			grid[y][x] = nearestCircle(x, y, circles)
+		}
+	}
+	return grid
+}
+
+// nearestCircle возвращает индекс круга с ближайшим к клетке центром или -1
+func nearestCircle(x, y int, circles []Circle) int {
+	nearest := -1
+	bestDist := 0
+	for idx, circle := range circles {
+		dx := x - circle.X
+		dy := y - circle.Y
+		dist := dx*dx + dy*dy
+		if nearest == -1 || dist < bestDist {
+			nearest = idx
+			bestDist = dist
+		}
+	}
+	return nearest
+}
+
+// mapFingerprint вычисляет SHA-256 от состояния клеток в каноническом порядке
+// (по y, затем x; числа внутри клетки отсортированы) и номера эпохи
+func mapFingerprint(epoch int, cells []Cell) string {
+	sorted := make([]Cell, len(cells))
+	copy(sorted, cells)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Y != sorted[j].Y {
+			return sorted[i].Y < sorted[j].Y
+		}
+		return sorted[i].X < sorted[j].X
+	})
+
+	h := sha256.New()
+	fmt.Fprintf(h, "epoch:%d\n", epoch)
+	for _, cell := range sorted {
+		vals := append([]int{}, cell.Vals...)
+		sort.Ints(vals)
+		fmt.Fprintf(h, "%d,%d:", cell.X, cell.Y)
+		for i, v := range vals {
+			if i > 0 {
+				h.Write([]byte(","))
+			}
+			fmt.Fprintf(h, "%d", v)
+		}
+		h.Write([]byte("\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cellCapacity возвращает, сколько чисел помещается в клетку данного типа:
+// белая - 2, синяя - 1, зеленая - 0
+func cellCapacity(cellType int) int {
+	switch cellType {
+	case 1:
+		return 1
+	case 2, 3:
+		return 0
+	}
+	return 2
+}
+
+const (
+	capacityConstant = "constant"
+	capacityLinear   = "linear"
+	capacityInverse  = "inverse"
+)
+
+// cellCapacityAt возвращает вместимость клетки (x, y) с учетом профиля
+// capacity_profile: базовая вместимость типа клетки уменьшается с расстоянием d
+// от центра карты (d от 0 в центре до 1 в углу):
+// linear - base*(1-d), inverse - base/(1+2d), constant - без изменений.
+func cellCapacityAt(cfg Config, circles []Circle, x, y int) int {
+	base := cellCapacity(getCellType(x, y, circles, cfg))
+	if cfg.CapacityProfile == "" || cfg.CapacityProfile == capacityConstant || base == 0 {
+		return base
+	}
+
+	cx, cy := float64(cfg.Width-1)/2, float64(cfg.Height-1)/2
+	maxDist := math.Hypot(cx, cy)
+	d := 0.0
+	if maxDist > 0 {
+		d = math.Hypot(float64(x)-cx, float64(y)-cy) / maxDist
+	}
+
+	var scaled float64
+	switch cfg.CapacityProfile {
+	case capacityLinear:
+		scaled = float64(base) * (1 - d)
+	case capacityInverse:
+		scaled = float64(base) / (1 + 2*d)
+	default:
+		return base
+	}
+	return int(math.Round(scaled))
+}
+
+// limitToCapacity обрезает числа клетки до её вместимости
+func limitToCapacity(cfg Config, circles []Circle, x, y int, vals []int) []int {
+	if capacity := cellCapacityAt(cfg, circles, x, y); len(vals) > capacity {
+		return vals[:capacity]
+	}
+	return vals
+}
+
+// validateCells проверяет клетки на соответствие геометрии карты: клетка
+// в пределах карты, не зеленая и не в рамке, чисел не больше вместимости, координаты не повторяются
+func validateCells(cfg Config, circles []Circle, cells []Cell) error {
+	seen := make(map[string]bool, len(cells))
+	for i, cell := range cells {
+		if cell.X < 0 || cell.X >= cfg.Width || cell.Y < 0 || cell.Y >= cfg.Height {
+			return fmt.Errorf("клетка [%d] (%d,%d) вне карты", i, cell.X, cell.Y)
+		}
+		if cell.Layer < 0 {
+			return fmt.Errorf("клетка [%d] (%d,%d): отрицательный слой %d", i, cell.X, cell.Y, cell.Layer)
+		}
+		key := fmt.Sprintf("%d,%d,%d", cell.X, cell.Y, cell.Layer)
+		if seen[key] {
+			return fmt.Errorf("клетка [%d] (%d,%d) указана повторно", i, cell.X, cell.Y)
+		}
+		seen[key] = true
+
+		cellType := getCellType(cell.X, cell.Y, circles, cfg)
+		if cellType == 2 {
+			return fmt.Errorf("клетка [%d] (%d,%d) зеленая и не может содержать числа", i, cell.X, cell.Y)
+		}
+		if cellType == 3 {
+			return fmt.Errorf("клетка [%d] (%d,%d) в рамке карты и не может содержать числа", i, cell.X, cell.Y)
+		}
+		if capacity := cellCapacityAt(cfg, circles, cell.X, cell.Y); len(cell.Vals) > capacity {
+			return fmt.Errorf("клетка [%d] (%d,%d): %d чисел при вместимости %d", i, cell.X, cell.Y, len(cell.Vals), capacity)
+		}
+		for _, val := range cell.Vals {
+			if val < 0 {
+				return fmt.Errorf("клетка [%d] (%d,%d): отрицательный индекс %d", i, cell.X, cell.Y, val)
+			}
+		}
+		if len(cell.Ages) > 0 && len(cell.Ages) != len(cell.Vals) {
+			return fmt.Errorf("клетка [%d] (%d,%d): длина ages не совпадает с indices", i, cell.X, cell.Y)
+		}
+	}
+	return nil
+}
+
+// sanitizeCells приводит клетки к их вместимости (cellCapacityAt: тип клетки
+// с учетом capacity_profile); лишние числа удаляются.
+// Возвращает очищенные клетки и количество удаленных чисел.
+func sanitizeCells(cfg Config, circles []Circle, cells []Cell) ([]Cell, int) {
+	result := []Cell{}
+	dropped := 0
+	for _, cell := range cells {
+		capacity := cellCapacityAt(cfg, circles, cell.X, cell.Y)
+		if len(cell.Vals) > capacity {
+			dropped += len(cell.Vals) - capacity
+			cell.Vals = cell.Vals[:capacity]
+			if len(cell.Ages) > capacity {
+				cell.Ages = cell.Ages[:capacity]
+			}
+		}
+		if len(cell.Vals) > 0 {
+			result = append(result, cell)
+		}
+	}
+	return result, dropped
+}
+
+// relocateCells приводит клетки к вместимости их текущего типа, как sanitizeCells,
+// но лишние числа переносит в ближайшие клетки со свободным местом.
+// Числа, которым места не нашлось, удаляются.
+func relocateCells(cfg Config, circles []Circle, cells []Cell) ([]Cell, int, int) {
+	type pending struct {
+		X, Y, Val, Age int
+	}
+
+	capacity := func(x, y int) int {
+		return cellCapacityAt(cfg, circles, x, y)
+	}
+
+	state := make(map[string]*Cell)
+	trackAges := false
+	excess := []pending{}
+	for _, cell := range cells {
+		if len(cell.Ages) > 0 {
+			trackAges = true
+		}
+		limit := capacity(cell.X, cell.Y)
+		kept := &Cell{X: cell.X, Y: cell.Y, Vals: []int{}, Ages: []int{}}
+		for i, val := range cell.Vals {
+			if len(kept.Vals) < limit {
+				kept.Vals = append(kept.Vals, val)
+				kept.Ages = append(kept.Ages, cell.age(i))
+			} else {
+				excess = append(excess, pending{cell.X, cell.Y, val, cell.age(i)})
+			}
+		}
+		state[fmt.Sprintf("%d,%d", cell.X, cell.Y)] = kept
+	}
+
+	relocated, dropped := 0, 0
+	for _, p := range excess {
+		placed := false
+		// Ищем свободную клетку по расширяющимся квадратным кольцам вокруг исходной
+		maxDist := cfg.Width + cfg.Height
+		for d := 1; d <= maxDist && !placed; d++ {
+			for y := p.Y - d; y <= p.Y+d && !placed; y++ {
+				for x := p.X - d; x <= p.X+d && !placed; x++ {
+					if x < 0 || y < 0 || x >= cfg.Width || y >= cfg.Height {
+						continue
+					}
+					if x != p.X-d && x != p.X+d && y != p.Y-d && y != p.Y+d {
+						continue
+					}
+					key := fmt.Sprintf("%d,%d", x, y)
+					target := state[key]
+					if target == nil {
+						target = &Cell{X: x, Y: y, Vals: []int{}, Ages: []int{}}
+						state[key] = target
+					}
+					if len(target.Vals) < capacity(x, y) {
+						target.Vals = append(target.Vals, p.Val)
+						target.Ages = append(target.Ages, p.Age)
+						placed = true
+					}
+				}
+			}
+		}
+		if placed {
+			relocated++
+		} else {
+			dropped++
+		}
+	}
+
+	result := []Cell{}
+	for y := 0; y < cfg.Height; y++ {
+		for x := 0; x < cfg.Width; x++ {
+			cell := state[fmt.Sprintf("%d,%d", x, y)]
+			if cell == nil || len(cell.Vals) == 0 {
+				continue
+			}
+			if !trackAges {
+				cell.Ages = nil
+			}
+			result = append(result, *cell)
+		}
+	}
+	return result, relocated, dropped
+}
+
+// Валидация данных
+func validateSpeeds(speeds []float64) error {
+	if len(speeds) == 0 {
+		return fmt.Errorf("массив скоростей не может быть пустым")
+	}
+	for i, speed := range speeds {
+		if speed < 0 || speed > 100 {
+			return fmt.Errorf("скорость [%d] должна быть от 0 до 100, получено: %f", i, speed)
+		}
+	}
+	return nil
+}
+
+// validateRing проверяет, что spawn на кольце помещаются в карту и не пересекаются
+func validateRing(cfg Config) error {
+	if cfg.RingRadius < 0 {
+		return fmt.Errorf("ring_radius не может быть отрицательным")
+	}
+	if cfg.Spawns == 0 {
+		return nil
+	}
+	r := ringRadius(cfg)
+	if r <= 0 && cfg.Spawns > 1 {
+		return fmt.Errorf("кольцо spawn не помещается в карту")
+	}
+	// Проверяем округленные позиции по тем же правилам, что и генератор:
+	// после округления соседние spawn могут сблизиться сильнее, чем по хорде
+	spawns := ringSpawns(cfg)
+	for i, c := range spawns {
+		if outOfBounds(cfg, c) {
+			return fmt.Errorf("кольцо радиуса %d выходит за границы карты", r)
+		}
+		if !canPlaceAmong(cfg, spawns[:i], c) {
+			return fmt.Errorf("на кольце радиуса %d не помещается %d spawn радиуса %d", r, cfg.Spawns, cfg.SpawnR)
+		}
+	}
+	return nil
+}
+
+func validateConfig(cfg Config) error {
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return fmt.Errorf("размеры карты должны быть положительными")
+	}
+	if cfg.Width > 100 || cfg.Height > 100 {
+		return fmt.Errorf("размеры карты слишком большие (max 100x100)")
+	}
+	if cfg.Spawns < 0 || cfg.Bedrooms < 0 {
+		return fmt.Errorf("количество spawn/bedroom не может быть отрицательным")
+	}
+	if cfg.CenterRadius < 0 {
+		return fmt.Errorf("center_radius не может быть отрицательным")
+	}
+	if cfg.Border < 0 {
+		return fmt.Errorf("border не может быть отрицательным")
+	}
+	if 2*cfg.Border >= cfg.Width || 2*cfg.Border >= cfg.Height {
+		return fmt.Errorf("рамка border=%d не оставляет внутренней области карты %dx%d", cfg.Border, cfg.Width, cfg.Height)
+	}
+	if cfg.CenterRadius > 0 {
+		// Сравниваем только с радиусами кругов, которые действительно будут размещены
+		counts := cfg
+		applyConfigDefaults(&counts)
+		if counts.Spawns > 0 && cfg.CenterRadius >= cfg.SpawnR {
+			return fmt.Errorf("center_radius должен быть меньше радиуса spawn")
+		}
+		if counts.Bedrooms > 0 && cfg.CenterRadius >= cfg.BedroomR {
+			return fmt.Errorf("center_radius должен быть меньше радиуса bedroom")
+		}
+	}
+	if cfg.MaxGap < 0 {
+		return fmt.Errorf("max_gap не может быть отрицательным")
+	}
+	if cfg.Jitter < 0 || math.IsNaN(cfg.Jitter) || math.IsInf(cfg.Jitter, 0) {
+		return fmt.Errorf("jitter должен быть неотрицательным числом")
+	}
+	if cfg.TotalCircles < 0 {
+		return fmt.Errorf("total_circles не может быть отрицательным")
+	}
+	if cfg.TotalCircles > 0 && (cfg.SpawnRatio <= 0 || cfg.SpawnRatio >= 1) {
+		return fmt.Errorf("spawn_ratio должен быть в интервале (0, 1)")
+	}
+	if cfg.PlacementAttempts < 0 || cfg.NearbyAttempts < 0 || cfg.MaxTotalAttempts < 0 {
+		return fmt.Errorf("лимиты попыток не могут быть отрицательными")
+	}
+	if b := cfg.Bias; b != nil {
+		if b.Strength < 0 || b.Strength > 1 {
+			return fmt.Errorf("сила смещения должна быть от 0 до 1")
+		}
+		if b.X < 0 || b.X >= cfg.Width || b.Y < 0 || b.Y >= cfg.Height {
+			return fmt.Errorf("точка смещения вне карты")
+		}
+	}
+	if a := cfg.BedroomAnchor; a != nil {
+		if cfg.Strategy == strategyHex {
+			return fmt.Errorf("bedroom_anchor не поддерживается стратегией hex")
+		}
+		if outOfBounds(cfg, Circle{X: a.X, Y: a.Y, Radius: cfg.BedroomR}) {
+			return fmt.Errorf("bedroom_anchor: bedroom радиуса %d в точке (%d, %d) выходит за границы карты", cfg.BedroomR, a.X, a.Y)
+		}
+		centered := cfg.CenterSpawn == nil || *cfg.CenterSpawn
+		if centered && cfg.Strategy != strategyRing && (cfg.Spawns > 0 || cfg.TotalCircles > 0) {
+			dx, dy := a.X-cfg.Width/2, a.Y-cfg.Height/2
+			if math.Sqrt(float64(dx*dx+dy*dy)) < float64(cfg.SpawnR+cfg.BedroomR) {
+				return fmt.Errorf("bedroom_anchor: bedroom пересекается с центральным spawn")
+			}
+		}
+	}
+	switch cfg.Strategy {
+	case "", strategyRandom, strategyHex:
+	case strategyRing:
+		if err := validateRing(cfg); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("неизвестная стратегия %q (random, hex или ring)", cfg.Strategy)
+	}
+	switch cfg.Neighborhood {
+	case "", neighborhoodMoore, neighborhoodVonNeumann:
+	default:
+		return fmt.Errorf("неизвестная окрестность %q (moore или von_neumann)", cfg.Neighborhood)
+	}
+	switch cfg.CapacityProfile {
+	case "", capacityConstant, capacityLinear, capacityInverse:
+	default:
+		return fmt.Errorf("неизвестный профиль вместимости %q (constant, linear или inverse)", cfg.CapacityProfile)
+	}
+	for circleType, m := range cfg.SpeedMultipliers {
+		if m < 0 || math.IsNaN(m) || math.IsInf(m, 0) {
+			return fmt.Errorf("множитель скорости для %q должен быть неотрицательным", circleType)
+		}
+	}
+	if cfg.MaxCells < 0 {
+		return fmt.Errorf("max_cells не может быть отрицательным")
+	}
+	if cfg.WebhookURL != "" {
+		u, err := url.Parse(cfg.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook_url должен быть абсолютным http(s) URL")
+		}
+	}
+	if cfg.DefaultProbabilities != nil {
+		if err := validateProbabilities(cfg.DefaultProbabilities, defaultSelectorResolution); err != nil {
+			return fmt.Errorf("default_probabilities: %v", err)
+		}
+	}
+	return nil
+}
+
+// downsampleCells оставляет limit случайных клеток, сохраняя порядок исходного списка
+func downsampleCells(rng *rand.Rand, cells []Cell, limit int) []Cell {
+	if len(cells) <= limit {
+		return cells
+	}
+	keep := make([]bool, len(cells))
+	for _, i := range rng.Perm(len(cells))[:limit] {
+		keep[i] = true
+	}
+	result := make([]Cell, 0, limit)
+	for i, cell := range cells {
+		if keep[i] {
+			result = append(result, cell)
+		}
+	}
+	return result
+}
+
+// hexPackingDensity - максимальная плотность упаковки равных кругов на плоскости
+var hexPackingDensity = math.Pi / (2 * math.Sqrt(3))
+
+// checkFeasibility оценивает, можно ли в принципе разместить круги конфигурации,
+// без запуска генерации. Возвращает ошибки (размещение невозможно)
+// и предупреждения (размещение маловероятно).
+func checkFeasibility(cfg Config) (errs []string, warnings []string) {
+	applyConfigDefaults(&cfg)
+
+	types := []struct {
+		name   string
+		count  int
+		radius int
+	}{
+		{"spawn", cfg.Spawns, cfg.SpawnR},
+		{"bedroom", cfg.Bedrooms, cfg.BedroomR},
+	}
+
+	circlesArea := 0.0
+	for _, t := range types {
+		if t.count == 0 {
+			continue
+		}
+		if 2*t.radius+1 > cfg.Width || 2*t.radius+1 > cfg.Height {
+			errs = append(errs, fmt.Sprintf("круг %s радиуса %d не помещается в карту %dx%d",
+				t.name, t.radius, cfg.Width, cfg.Height))
+		}
+		circlesArea += float64(t.count) * math.Pi * float64(t.radius*t.radius)
+	}
+
+	density := circlesArea / float64(cfg.Width*cfg.Height)
+	switch {
+	case density > 1:
+		errs = append(errs, fmt.Sprintf("суммарная площадь кругов превышает площадь карты (%.0f%%)", density*100))
+	case density > hexPackingDensity:
+		warnings = append(warnings, fmt.Sprintf("плотность кругов %.0f%% выше предельной плотности упаковки %.0f%%",
+			density*100, hexPackingDensity*100))
+	}
+	return errs, warnings
+}
+
+// validateConfigHandler проверяет конфигурацию карты без генерации
+func validateConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var cfg Config
+	if err := decodeJSON(r, &cfg); err != nil {
+		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := struct {
+		Valid    bool     `json:"valid"`
+		Errors   []string `json:"errors,omitempty"`
+		Warnings []string `json:"warnings,omitempty"`
+	}{}
+	if err := validateConfig(cfg); err != nil {
+		resp.Errors = []string{err.Error()}
+	} else {
+		resp.Errors, resp.Warnings = checkFeasibility(cfg)
+	}
+	resp.Valid = len(resp.Errors) == 0
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HTTP Handlers
+
+func createMapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Name         string `json:"name"`
+		Config       Config `json:"config"`
+		AllowPartial bool   `json:"allow_partial"`
+
+		// Минимальная доля клеток внутри кругов и число перегенераций для её достижения
+		MinCoverage     float64 `json:"min_coverage"`
+		CoverageRetries int     `json:"coverage_retries"`
+	}
+
+	if err := decodeJSON(r, &req); err != nil {
+		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateConfig(req.Config); err != nil {
+		http.Error(w, "Некорректная конфигурация: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.MinCoverage < 0 || req.MinCoverage > 1 {
+		http.Error(w, "min_coverage должен быть от 0 до 1", http.StatusBadRequest)
+		return
+	}
+	if req.CoverageRetries < 0 || req.CoverageRetries > maxCoverageRetries {
+		http.Error(w, fmt.Sprintf("coverage_retries должен быть от 0 до %d", maxCoverageRetries), http.StatusBadRequest)
+		return
+	}
+	if req.MinCoverage > 0 && req.CoverageRetries == 0 {
+		req.CoverageRetries = defaultCoverageRetries
+	}
+
+	// Повторный запрос с тем же ключом возвращает ранее созданную карту
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey != "" {
+		mapID, found, err := lookupIdempotencyKey(idempotencyKey)
+		if err != nil {
+			http.Error(w, "Ошибка проверки Idempotency-Key: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if found {
+			m, err := loadMap(mapID)
+			if err == nil {
+				log.Printf("🔁 Повторный запрос с ключом %q, возвращаем карту %d", idempotencyKey, mapID)
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(m)
+				return
+			}
+			if err != sql.ErrNoRows {
+				http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// Карта была удалена - создаем заново
+		}
+	}
+
+	if req.Name == "" {
+		req.Name = fmt.Sprintf("map_%d", time.Now().Unix())
+	}
+
+	var gen *MapGenerator
+	var partial *PartialGeneration
+	var coverage float64
+	for attempt := 0; ; attempt++ {
+		gen = NewMapGenerator(req.Config)
+		partial = nil
+		if err := gen.Generate(); err != nil {
+			if !req.AllowPartial {
+				http.Error(w, "Ошибка генерации: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			// Сохраняем то, что успели разместить
+			partial = &PartialGeneration{
+				Warning:           "Частичная генерация: " + err.Error(),
+				PlacedSpawns:      len(gen.spawns),
+				PlacedBedrooms:    len(gen.bedrooms),
+				RequestedSpawns:   gen.config.Spawns,
+				RequestedBedrooms: gen.config.Bedrooms,
+			}
+			log.Printf("⚠️  %s", partial.Warning)
+		}
+
+		coverage = computeCoverage(req.Config, gen.getAllCircles())
+		if coverage >= req.MinCoverage {
+			break
+		}
+		if attempt >= req.CoverageRetries {
+			http.Error(w, fmt.Sprintf("Покрытие %.3f ниже требуемого %.3f после %d попыток",
+				coverage, req.MinCoverage, attempt+1), http.StatusUnprocessableEntity)
+			return
+		}
+		log.Printf("🔄 Покрытие %.3f ниже %.3f, перегенерация (%d/%d)", coverage, req.MinCoverage, attempt+1, req.CoverageRetries)
+	}
+
+	circles := gen.getAllCircles()
+	configBytes, _ := json.Marshal(req.Config)
+	circlesBytes, _ := json.Marshal(circles)
+
+	res, err := db.Exec("INSERT INTO maps (name, config, circles) VALUES (?, ?, ?)",
+		req.Name, string(configBytes), string(circlesBytes))
+	if err != nil {
+		http.Error(w, "Ошибка сохранения в БД: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := res.LastInsertId()
+	if idempotencyKey != "" {
+		_, err := db.Exec("INSERT OR REPLACE INTO idempotency_keys (key, map_id, created_at) VALUES (?, ?, ?)",
+			idempotencyKey, id, time.Now().Unix())
+		if err != nil {
+			log.Printf("⚠️  Не удалось сохранить Idempotency-Key: %v", err)
+		}
+	}
+
+	originalBytes, _ := json.Marshal(req.Config)
+	mapLogf(int(id), "🗺️  Карта %d создана, исходная конфигурация: %s", id, originalBytes)
+
+	resp := struct {
+		Map
+		EffectiveConfig Config             `json:"effective_config"`
+		Coverage        float64            `json:"coverage"`
+		AttemptsUsed    int                `json:"attempts_used"`
+		Partial         *PartialGeneration `json:"partial,omitempty"`
+	}{
+		Map: Map{
+			ID:      int(id),
+			Name:    req.Name,
+			Config:  req.Config,
+			Circles: circles,
+			Speeds:  []float64{},
+			Epoch:   0,
+			Created: time.Now(),
+		},
+		EffectiveConfig: gen.config,
+		Coverage:        coverage,
+		AttemptsUsed:    gen.attempts,
+		Partial:         partial,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// generateStreamHandler генерирует карту и отправляет прогресс через SSE.
+// Конфигурация передается JSON-строкой в параметре ?config=, имя - в ?name=.
+func generateStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Потоковая передача не поддерживается", http.StatusInternalServerError)
+		return
+	}
+
+	var cfg Config
+	decoder := json.NewDecoder(strings.NewReader(r.URL.Query().Get("config")))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		http.Error(w, "Некорректный JSON в параметре config: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateConfig(cfg); err != nil {
+		http.Error(w, "Некорректная конфигурация: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = fmt.Sprintf("map_%d", time.Now().Unix())
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	sendEvent := func(event string, data interface{}) {
+		payload, _ := json.Marshal(data)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+		flusher.Flush()
+	}
+
+	gen := NewMapGenerator(cfg)
+	placed := 0
+	gen.onPlace = func(c Circle) {
+		placed++
+		sendEvent("circle", struct {
+			Placed int    `json:"placed"`
+			Total  int    `json:"total"`
+			Circle Circle `json:"circle"`
+		}{placed, gen.config.Spawns + gen.config.Bedrooms, c})
+	}
+
+	if err := gen.Generate(); err != nil {
+		sendEvent("error", map[string]string{"error": "Ошибка генерации: " + err.Error()})
+		return
+	}
+
+	circles := gen.getAllCircles()
+	configBytes, _ := json.Marshal(cfg)
+	circlesBytes, _ := json.Marshal(circles)
+	res, err := db.Exec("INSERT INTO maps (name, config, circles) VALUES (?, ?, ?)",
+		name, string(configBytes), string(circlesBytes))
+	if err != nil {
+		sendEvent("error", map[string]string{"error": "Ошибка сохранения в БД: " + err.Error()})
+		return
+	}
+	id, _ := res.LastInsertId()
+	mapLogf(int(id), "📡 Карта %d сгенерирована потоково: %d кругов", id, len(circles))
+
+	sendEvent("done", struct {
+		MapID   int `json:"map_id"`
+		Circles int `json:"circles"`
+	}{int(id), len(circles)})
+}
+
+func importMapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Name         string   `json:"name"`
+		Config       Config   `json:"config"`
+		Circles      []Circle `json:"circles"`
+		AllowOverlap bool     `json:"allow_overlap"`
+	}
+
+	if err := decodeJSON(r, &req); err != nil {
+		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateConfig(req.Config); err != nil {
+		http.Error(w, "Некорректная конфигурация: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Circles == nil {
+		req.Circles = []Circle{}
+	}
+	for i, c := range req.Circles {
+		if c.Radius < 0 {
+			http.Error(w, fmt.Sprintf("Круг %d: радиус не может быть отрицательным", i), http.StatusBadRequest)
+			return
+		}
+		if c.Type != "spawn" && c.Type != "bedroom" {
+			http.Error(w, fmt.Sprintf("Круг %d: тип должен быть spawn или bedroom, получено %q", i, c.Type), http.StatusBadRequest)
+			return
+		}
+		if req.Config.CenterRadius > 0 && c.Radius <= req.Config.CenterRadius {
+			http.Error(w, fmt.Sprintf("Круг %d: радиус %d должен быть больше center_radius=%d", i, c.Radius, req.Config.CenterRadius),
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !req.AllowOverlap {
+		if conflicts := findCircleConflicts(req.Config, req.Circles); len(conflicts) > 0 {
+			resp := struct {
+				Error     string           `json:"error"`
+				Conflicts []CircleConflict `json:"conflicts"`
+			}{"Круги пересекаются или выходят за границы карты", conflicts}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+	}
+
+	if req.Name == "" {
+		req.Name = fmt.Sprintf("map_%d", time.Now().Unix())
+	}
+
+	configBytes, _ := json.Marshal(req.Config)
+	circlesBytes, _ := json.Marshal(req.Circles)
+
+	res, err := db.Exec("INSERT INTO maps (name, config, circles) VALUES (?, ?, ?)",
+		req.Name, string(configBytes), string(circlesBytes))
+	if err != nil {
+		http.Error(w, "Ошибка сохранения в БД: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := res.LastInsertId()
+	mapLogf(int(id), "📥 Импортирована карта %d (%s): %d кругов", id, req.Name, len(req.Circles))
+
+	resp := Map{
+		ID:      int(id),
+		Name:    req.Name,
+		Config:  req.Config,
+		Circles: req.Circles,
+		Speeds:  []float64{},
+		Epoch:   0,
+		Created: time.Now(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func distributeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		MapID         int       `json:"map_id"`
+		Probabilities []float64 `json:"probabilities"`
+		Resolution    int       `json:"resolution"`
+		FillRate      float64   `json:"fill_rate"`
+		// Отдельные вероятности для синих (комнаты) и белых (открытые области) клеток;
+		// если не заданы, используется probabilities
+		BlueProbabilities  []float64 `json:"blue_probabilities"`
+		WhiteProbabilities []float64 `json:"white_probabilities"`
+		MaxValues          int       `json:"max_values"` // индексы >= max_values сворачиваются в один
+		// Количество чисел в белых клетках по расстоянию до кругов
+		DensityBands []DensityBand `json:"density_bands"`
+		// Слой популяции: клетки других слоев сохраняются без изменений
+		Layer int `json:"layer"`
+	}
+
+	if err := decodeJSON(r, &req); err != nil {
+		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	pageParams, err := parseCellPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Resolution == 0 {
+		req.Resolution = defaultSelectorResolution
+	}
+	if req.Resolution < 0 {
+		http.Error(w, "Разрешение селектора должно быть положительным", http.StatusBadRequest)
+		return
+	}
+	if err := validateDensityBands(req.DensityBands); err != nil {
+		http.Error(w, "Некорректные density_bands: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.MaxValues < 0 {
+		http.Error(w, "max_values не может быть отрицательным", http.StatusBadRequest)
+		return
+	}
+	req.Probabilities = collapseProbabilities(req.Probabilities, req.MaxValues)
+	for _, typed := range []struct {
+		name  string
+		probs *[]float64
+	}{{"blue_probabilities", &req.BlueProbabilities}, {"white_probabilities", &req.WhiteProbabilities}} {
+		if *typed.probs == nil {
+			continue
+		}
+		*typed.probs = collapseProbabilities(*typed.probs, req.MaxValues)
+		if err := validateProbabilities(*typed.probs, req.Resolution); err != nil {
+			http.Error(w, "Некорректные "+typed.name+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.FillRate < 0 || req.FillRate > 1 {
+		http.Error(w, "fill_rate должен быть от 0 до 1", http.StatusBadRequest)
+		return
+	}
+	if req.Layer < 0 {
+		http.Error(w, "layer не может быть отрицательным", http.StatusBadRequest)
+		return
+	}
+	if (req.BlueProbabilities != nil || req.WhiteProbabilities != nil) && req.FillRate > 0 && req.FillRate < 1 {
+		http.Error(w, "blue_probabilities и white_probabilities не поддерживаются при постепенном заполнении", http.StatusBadRequest)
+		return
+	}
+	if req.Layer > 0 && req.FillRate > 0 && req.FillRate < 1 {
+		http.Error(w, "Постепенное заполнение поддерживается только для слоя 0", http.StatusBadRequest)
+		return
+	}
+	if size := selectorSize(req.Probabilities, req.Resolution); size > maxSelectorSize {
+		http.Error(w, fmt.Sprintf("Слишком большой селектор: %d элементов (max %d), уменьшите resolution",
+			size, maxSelectorSize), http.StatusBadRequest)
+		return
+	}
+	// Пустой селектор означает, что распределение не создаст ни одного числа
+	for _, typed := range [][]float64{req.BlueProbabilities, req.WhiteProbabilities} {
+		effective := typed
+		if len(effective) == 0 {
+			effective = req.Probabilities
+		}
+		if selectorSize(effective, req.Resolution) == 0 {
+			http.Error(w, fmt.Sprintf("Вероятности не дают ни одного значения для выбора при resolution %d: "+
+				"увеличьте вероятности или resolution", req.Resolution), http.StatusBadRequest)
+			return
+		}
+	}
+
+	unlock := mapLocks.lock(req.MapID)
+	defer unlock()
+
+	m, err := loadMap(req.MapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	cfg, circles := m.Config, m.Circles
+
+	var cells []Cell
+	var fill *FillState
+	if req.FillRate > 0 && req.FillRate < 1 {
+		// Постепенное заполнение: сейчас только часть клеток, остальное по эпохам
+		fill = &FillState{
+			Probabilities: req.Probabilities,
+			Resolution:    req.Resolution,
+			Rate:          req.FillRate,
+			Target:        countFillable(cfg, circles),
+		}
+		cells, fill.Filled = fillCells(cfg, circles, []Cell{}, *fill, fillStep(*fill))
+	} else {
+		cells = generateTypedDistribution(cfg, circles, req.Probabilities, req.BlueProbabilities, req.WhiteProbabilities,
+			req.Resolution, req.DensityBands)
+	}
+
+	generated := len(cells)
+	cells, err = limitCells(cfg, cells)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if len(cells) < generated {
+		mapLogf(req.MapID, "✂️  Карта %d: распределение прорежено с %d до %d клеток", req.MapID, generated, len(cells))
+	}
+	cells = setLayer(cells, req.Layer)
+
+	if err := saveDistribution(m, req.Layer, cells, fill, false); err != nil {
+		http.Error(w, "Ошибка сохранения распределения: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mapLogf(req.MapID, "🔢 Карта %d: распределено клеток %d (слой %d)", req.MapID, len(cells), req.Layer)
+
+	page, next := pageParams.apply(cells)
+	resp := struct {
+		MapID   int               `json:"map_id"`
+		Cells   []Cell            `json:"cells"`
+		Fill    *FillState        `json:"fill,omitempty"`
+		Legend  map[string]string `json:"legend"`
+		Warning string            `json:"warning,omitempty"`
+
+		NextCursor string `json:"next_cursor,omitempty"`
+
+		// Число клеток до прореживания по max_cells
+		DownsampledFrom int `json:"downsampled_from,omitempty"`
+	}{req.MapID, page, fill, cellTypeLegend, circlesWarning(circles), next, 0}
+	if len(cells) < generated {
+		resp.DownsampledFrom = generated
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// maxBatchDistribute - максимальное число карт в одном запросе /api/distribute/batch
+const maxBatchDistribute = 100
+
+// BatchDistributeItem - распределение для одной карты в пакетном запросе
+type BatchDistributeItem struct {
+	MapID         int       `json:"map_id"`
+	Probabilities []float64 `json:"probabilities"`
+	Resolution    int       `json:"resolution"`
+}
+
+// BatchDistributeResult - итог распределения одной карты пакета
+type BatchDistributeResult struct {
+	MapID int    `json:"map_id"`
+	OK    bool   `json:"ok"`
+	Cells int    `json:"cells,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// distributeMap генерирует распределение слоя 0 карты и сохраняет его в отдельной
+// транзакции вместе со сбросом постепенного заполнения. Возвращает число клеток.
+func distributeMap(item BatchDistributeItem) (int, error) {
+	if item.Resolution == 0 {
+		item.Resolution = defaultSelectorResolution
+	}
+	if item.Resolution < 0 {
+		return 0, fmt.Errorf("разрешение селектора должно быть положительным")
+	}
+	if err := validateProbabilities(item.Probabilities, item.Resolution); err != nil {
+		return 0, err
+	}
+
+	unlock := mapLocks.lock(item.MapID)
+	defer unlock()
+
+	m, err := loadMap(item.MapID)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("карта не найдена")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("загрузка карты: %v", err)
+	}
+
+	cells := generateDistribution(m.Config, m.Circles, item.Probabilities, item.Resolution, nil)
+	cells, err = limitCells(m.Config, cells)
+	if err != nil {
+		return 0, err
+	}
+	if err := saveDistribution(m, 0, cells, nil, true); err != nil {
+		return 0, err
+	}
+	return len(cells), nil
+}
+
+// limitCells применяет config.max_cells к распределению: лишние клетки
+// прореживаются при downsample_cells, иначе возвращается ошибка
+func limitCells(cfg Config, cells []Cell) ([]Cell, error) {
+	if cfg.MaxCells <= 0 || len(cells) <= cfg.MaxCells {
+		return cells, nil
+	}
+	if !cfg.DownsampleCells {
+		return nil, fmt.Errorf("распределение содержит %d клеток, больше лимита max_cells=%d", len(cells), cfg.MaxCells)
+	}
+	return downsampleCells(newRNG(), cells, cfg.MaxCells), nil
+}
+
+// saveDistribution заменяет клетки слоя layer карты m новым распределением в одной
+// транзакции; клетки других слоев остаются на месте. Для слоя 0 сохраняется
+// прогресс постепенного заполнения (nil сбрасывает его). При historyRequired
+// снимок истории пишется в той же транзакции и его ошибка отменяет сохранение,
+// иначе снимок пишется после коммита и ошибка только попадает в лог.
+func saveDistribution(m Map, layer int, cells []Cell, fill *FillState, historyRequired bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("начало транзакции: %v", err)
+	}
+	defer tx.Rollback()
+
+	existing, err := loadCellsForUpdate(tx, m.ID)
+	if err != nil {
+		return fmt.Errorf("загрузка клеток: %v", err)
+	}
+	allCells := append([]Cell{}, cells...)
+	for _, cell := range existing {
+		if cell.Layer != layer {
+			allCells = append(allCells, cell)
+		}
+	}
+
+	if err := saveCellsTx(tx, m.ID, allCells); err != nil {
+		return err
+	}
+	// Прогресс постепенного заполнения относится только к слою 0
+	if layer == 0 {
+		fillBytes := []byte{}
+		if fill != nil {
+			fillBytes, _ = json.Marshal(fill)
+		}
+		if _, err := tx.Exec("UPDATE maps SET fill_state = ? WHERE id = ?", string(fillBytes), m.ID); err != nil {
+			return fmt.Errorf("сохранение прогресса заполнения: %v", err)
+		}
+	}
+	if m.Config.History && historyRequired {
+		if err := saveHistorySnapshot(tx, m.ID, m.Epoch, allCells); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("коммит транзакции: %v", err)
+	}
+	if m.Config.History && !historyRequired {
+		if err := saveHistorySnapshot(db, m.ID, m.Epoch, allCells); err != nil {
+			mapLogf(m.ID, "⚠️  Карта %d: %v", m.ID, err)
+		}
+	}
+	return nil
+}
+
+// distributeBatchHandler распределяет числа сразу по нескольким картам.
+// Ошибка одной карты не отменяет распределение остальных.
+func distributeBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var items []BatchDistributeItem
+	if err := decodeJSON(r, &items); err != nil {
+		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(items) == 0 {
+		http.Error(w, "Список карт не может быть пустым", http.StatusBadRequest)
+		return
+	}
+	if len(items) > maxBatchDistribute {
+		http.Error(w, fmt.Sprintf("Слишком много карт в пакете: %d (max %d)", len(items), maxBatchDistribute), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]BatchDistributeResult, len(items))
+	succeeded := 0
+	for i, item := range items {
+		results[i].MapID = item.MapID
+		n, err := distributeMap(item)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].OK = true
+		results[i].Cells = n
+		succeeded++
+		mapLogf(item.MapID, "🔢 Карта %d: распределено клеток %d (пакет)", item.MapID, n)
+	}
+	log.Printf("📦 Пакетное распределение: успешно %d из %d карт", succeeded, len(items))
+
+	resp := struct {
+		Succeeded int                     `json:"succeeded"`
+		Failed    int                     `json:"failed"`
+		Results   []BatchDistributeResult `json:"results"`
+	}{succeeded, len(items) - succeeded, results}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// loadLayerSpeeds загружает скорости дополнительных слоев карты (слой 0 хранится в speeds)
+func loadLayerSpeeds(mapID int) (map[int][]float64, error) {
+	var layerStr sql.NullString
+	if err := db.QueryRow("SELECT layer_speeds FROM maps WHERE id = ?", mapID).Scan(&layerStr); err != nil {
+		return nil, err
+	}
+	speeds := make(map[int][]float64)
+	if layerStr.Valid && layerStr.String != "" {
+		if err := json.Unmarshal([]byte(layerStr.String), &speeds); err != nil {
+			return nil, fmt.Errorf("парсинг layer_speeds: %v", err)
+		}
+	}
+	return speeds, nil
+}
+
+// saveLayerSpeeds сохраняет скорости слоя layer > 0
+func saveLayerSpeeds(mapID, layer int, speeds []float64) error {
+	layerSpeeds, err := loadLayerSpeeds(mapID)
+	if err != nil {
+		return err
+	}
+	layerSpeeds[layer] = speeds
+	layerBytes, _ := json.Marshal(layerSpeeds)
+	_, err = db.Exec("UPDATE maps SET layer_speeds = ? WHERE id = ?", string(layerBytes), mapID)
+	return err
+}
+
+func setSpeedsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req SetSpeedsRequest
+	if err := decodeJSON(r, &req); err != nil {
+		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Preset != "" {
+		if len(req.Speeds) > 0 {
+			http.Error(w, "Укажите либо speeds, либо preset", http.StatusBadRequest)
+			return
+		}
+		var speedsStr string
+		err := db.QueryRow("SELECT speeds FROM speed_presets WHERE name = ?", req.Preset).Scan(&speedsStr)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Пресет не найден: "+req.Preset, http.StatusNotFound)
+			} else {
+				http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		if err := json.Unmarshal([]byte(speedsStr), &req.Speeds); err != nil {
+			http.Error(w, "Ошибка парсинга пресета: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := validateSpeeds(req.Speeds); err != nil {
+		http.Error(w, "Некорректные скорости: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Layer < 0 {
+		http.Error(w, "layer не может быть отрицательным", http.StatusBadRequest)
+		return
+	}
+	if req.Precision != nil {
+		if *req.Precision < 0 || *req.Precision > maxSpeedPrecision {
+			http.Error(w, fmt.Sprintf("precision должен быть от 0 до %d", maxSpeedPrecision), http.StatusBadRequest)
+			return
+		}
+		req.Speeds = roundSpeeds(req.Speeds, *req.Precision)
+	}
+
+	unlock := mapLocks.lock(req.MapID)
+	defer unlock()
+
+	var exists int
+	err := db.QueryRow("SELECT COUNT(*) FROM maps WHERE id = ? AND deleted_at IS NULL", req.MapID).Scan(&exists)
+	if err != nil || exists == 0 {
+		writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		return
+	}
+
+	if req.Layer > 0 {
+		err = saveLayerSpeeds(req.MapID, req.Layer, req.Speeds)
+	} else {
+		speedBytes, _ := json.Marshal(req.Speeds)
+		_, err = db.Exec("UPDATE maps SET speeds = ? WHERE id = ?", string(speedBytes), req.MapID)
+	}
+	if err != nil {
+		log.Printf("❌ Ошибка SQL при сохранении скоростей: %v", err)
+		http.Error(w, "Ошибка сохранения скоростей: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	mapLogf(req.MapID, "✅ Скорости сохранены для карты %d (слой %d)", req.MapID, req.Layer)
+
+	resp := struct {
+		MapID   int       `json:"map_id"`
+		Layer   int       `json:"layer"`
+		Speeds  []float64 `json:"speeds"`
+		Success bool      `json:"success"`
+	}{req.MapID, req.Layer, req.Speeds, true}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// getSpeedsHandler возвращает сохраненные скорости карты (пустой массив, если не заданы)
+func getSpeedsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	layer := 0
+	if v := r.URL.Query().Get("layer"); v != "" {
+		layer, err = strconv.Atoi(v)
+		if err != nil || layer < 0 {
+			http.Error(w, "Некорректный layer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var speedsStr sql.NullString
+	err = db.QueryRow("SELECT speeds FROM maps WHERE id = ? AND deleted_at IS NULL", mapID).Scan(&speedsStr)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	speeds := []float64{}
+	if layer > 0 {
+		layerSpeeds, err := loadLayerSpeeds(mapID)
+		if err != nil {
+			http.Error(w, "Ошибка загрузки скоростей слоев: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if layerSpeeds[layer] != nil {
+			speeds = layerSpeeds[layer]
+		}
+	} else if speedsStr.Valid && speedsStr.String != "" {
+		if err := json.Unmarshal([]byte(speedsStr.String), &speeds); err != nil {
+			http.Error(w, "Ошибка парсинга speeds: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if speeds == nil {
+		speeds = []float64{}
+	}
+
+	resp := struct {
+		MapID  int       `json:"map_id"`
+		Layer  int       `json:"layer"`
+		Speeds []float64 `json:"speeds"`
+	}{mapID, layer, speeds}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func presetsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := db.Query("SELECT name, speeds FROM speed_presets ORDER BY name")
+		if err != nil {
+			http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		presets := []SpeedPreset{}
+		for rows.Next() {
+			var p SpeedPreset
+			var speedsStr string
+			if err := rows.Scan(&p.Name, &speedsStr); err != nil {
+				http.Error(w, "Ошибка чтения пресета: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := json.Unmarshal([]byte(speedsStr), &p.Speeds); err != nil {
+				http.Error(w, "Ошибка парсинга пресета: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			presets = append(presets, p)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(presets)
+
+	case http.MethodPost:
+		var req SpeedPreset
+		if err := decodeJSON(r, &req); err != nil {
+			http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" {
+			http.Error(w, "Имя пресета не может быть пустым", http.StatusBadRequest)
+			return
+		}
+		if err := validateSpeeds(req.Speeds); err != nil {
+			http.Error(w, "Некорректные скорости: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		speedBytes, _ := json.Marshal(req.Speeds)
+		_, err := db.Exec("INSERT OR REPLACE INTO speed_presets (name, speeds) VALUES (?, ?)", req.Name, string(speedBytes))
+		if err != nil {
+			http.Error(w, "Ошибка сохранения пресета: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("✅ Пресет скоростей %q сохранен", req.Name)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(req)
+
+	default:
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+	}
+}
+
+func newEpochHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req NewEpochRequest
+	if err := decodeJSON(r, &req); err != nil {
+		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.MaxAge < 0 {
+		http.Error(w, "max_age не может быть отрицательным", http.StatusBadRequest)
+		return
+	}
+	if req.Decay < 0 || req.Decay > 1 || math.IsNaN(req.Decay) {
+		http.Error(w, "decay должен быть от 0 до 1", http.StatusBadRequest)
+		return
+	}
+	if req.Cohesion < 0 {
+		http.Error(w, "cohesion не может быть отрицательным", http.StatusBadRequest)
+		return
+	}
+	immovable := make(map[int]bool, len(req.Immovable))
+	for i, val := range req.Immovable {
+		if val < 0 {
+			http.Error(w, fmt.Sprintf("immovable[%d] не может быть отрицательным", i), http.StatusBadRequest)
+			return
+		}
+		immovable[val] = true
+	}
+	pageParams, err := parseCellPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.MaxStepsPerMove < 0 || req.MaxStepsPerMove > maxStepsPerMove {
+		http.Error(w, fmt.Sprintf("max_steps_per_move должен быть от 0 до %d", maxStepsPerMove), http.StatusBadRequest)
+		return
+	}
+	if err := validateValueInteractions(req.ValueInteractions); err != nil {
+		http.Error(w, "Некорректные value_interactions: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch req.WhenBlocked {
+	case "", blockedStay, blockedSwap, blockedWaitRetry:
+	default:
+		http.Error(w, fmt.Sprintf("Неизвестное when_blocked %q (stay, swap или wait-and-retry)", req.WhenBlocked), http.StatusBadRequest)
+		return
+	}
+	switch req.SortDirection {
+	case "", sortLower, sortHigher:
+	default:
+		http.Error(w, fmt.Sprintf("Неизвестное sort_direction %q (lower или higher)", req.SortDirection), http.StatusBadRequest)
+		return
+	}
+	directionWeights, err := parseDirectionWeights(req.DirectionWeights)
+	if err != nil {
+		http.Error(w, "Некорректные direction_weights: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	unlock := mapLocks.lock(req.MapID)
+	defer unlock()
+
+	m, err := loadMap(req.MapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			log.Printf("❌ Ошибка SQL: %v", err)
+			http.Error(w, "Ошибка БД при получении карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	cfg, circles := m.Config, m.Circles
+
+	// Получаем текущие клетки из БД
+	cells, err := loadCellsForUpdate(db, req.MapID)
+	if err != nil {
+		log.Printf("⚠️  Ошибка загрузки клеток: %v", err)
+		http.Error(w, "Ошибка загрузки клеток: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Если клеток нет, генерируем начальное распределение
+	if len(cells) == 0 {
+		cells = generateDistribution(cfg, circles, initialProbabilities(cfg), defaultSelectorResolution, nil)
+		mapLogf(req.MapID, "📋 Сгенерировано начальное распределение для карты %d", req.MapID)
+	}
+
+	// Дозаполняем карту, если включено постепенное заполнение
+	var fill *FillState
+	var fillStr sql.NullString
+	if req.Fill {
+		if err := db.QueryRow("SELECT fill_state FROM maps WHERE id = ?", req.MapID).Scan(&fillStr); err != nil {
+			http.Error(w, "Ошибка БД при получении fill_state: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if fillStr.Valid && fillStr.String != "" {
+		fill = &FillState{}
+		if err := json.Unmarshal([]byte(fillStr.String), fill); err != nil {
+			http.Error(w, "Ошибка парсинга fill_state: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if fill.Filled < fill.Target {
+			var added int
+			cells, added = fillCells(cfg, circles, cells, *fill, fillStep(*fill))
+			fill.Filled += added
+			if added == 0 {
+				fill.Filled = fill.Target // свободных клеток не осталось
+			}
+			if !req.DryRun {
+				fillBytes, _ := json.Marshal(fill)
+				if _, err := db.Exec("UPDATE maps SET fill_state = ? WHERE id = ?", string(fillBytes), req.MapID); err != nil {
+					http.Error(w, "Ошибка сохранения прогресса заполнения: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			mapLogf(req.MapID, "🌱 Карта %d: заполнено %d/%d клеток", req.MapID, fill.Filled, fill.Target)
+		}
+	}
+
+	// Один генератор на эпоху: движение и исчезновение чисел
+	cells, stats, decayed, died, err := runEpochStep(newRNG(), m, cells, EpochStep{
+		Move: MoveOptions{
+			Cohesion:          req.Cohesion,
+			Immovable:         immovable,
+			DirectionWeights:  directionWeights,
+			WhenBlocked:       req.WhenBlocked,
+			ValueInteractions: req.ValueInteractions,
+			RecordTransitions: req.Transitions,
+			MaxSteps:          req.MaxStepsPerMove,
+			SortDirection:     req.SortDirection,
+		},
+		Decay:  req.Decay,
+		MaxAge: req.MaxAge,
+	})
+	if err != nil {
+		http.Error(w, "Ошибка расчета эпохи: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var transitions []Transition
+	if stats != nil {
+		transitions = stats.Transitions
+		mapLogf(req.MapID, "🎯 Применено движение чисел для карты %d: перемещено %d, на месте %d", req.MapID, stats.Moved, stats.Stayed)
+	} else {
+		mapLogf(req.MapID, "⚠️  Скорости не установлены для карты %d, числа не двигаются", req.MapID)
+	}
+	if req.Decay > 0 {
+		mapLogf(req.MapID, "🍂 Карта %d: исчезло чисел %d", req.MapID, decayed)
+	}
+	if req.MaxAge > 0 {
+		mapLogf(req.MapID, "💀 Карта %d: умерло чисел %d", req.MapID, died)
+	}
+
+	currentEpoch := m.Epoch + 1
+
+	// В режиме dry_run состояние не сохраняется: ответ показывает следующую эпоху
+	if req.DryRun {
+		mapLogf(req.MapID, "👀 Карта %d: пробный расчет эпохи %d без сохранения", req.MapID, currentEpoch)
+	} else if err := saveEpoch(m, currentEpoch, cells); err != nil {
+		log.Printf("❌ Ошибка сохранения эпохи: %v", err)
+		http.Error(w, "Ошибка сохранения эпохи: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page, next := pageParams.apply(cells)
+	resp := struct {
+		MapID   int               `json:"map_id"`
+		Epoch   int               `json:"epoch"`
+		Cells   []Cell            `json:"cells"`
+		Fill    *FillState        `json:"fill,omitempty"`
+		Died    int               `json:"died"`
+		Decayed int               `json:"decayed"`
+		Stats   *MoveStats        `json:"movement_stats,omitempty"`
+		Legend  map[string]string `json:"legend"`
+		Warning string            `json:"warning,omitempty"`
+		DryRun  bool              `json:"dry_run,omitempty"`
+
+		NextCursor  string       `json:"next_cursor,omitempty"`
+		Transitions []Transition `json:"transitions,omitempty"`
+	}{req.MapID, currentEpoch, page, fill, died, decayed, stats, cellTypeLegend, circlesWarning(circles), req.DryRun, next, transitions}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Коды ошибок в JSON-ответах: позволяют отличить неизвестный URL от отсутствующей карты
+const (
+	errCodeRouteNotFound = "route_not_found"
+	errCodeMapNotFound   = "map_not_found"
+)
+
+// writeJSONError отвечает ошибкой вида {"error":{"code":..., "message":...}}
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	resp := struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	resp.Error.Code = code
+	resp.Error.Message = message
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Параметры доставки webhook: таймаут одного запроса и число попыток
+const (
+	webhookTimeout  = 5 * time.Second
+	webhookAttempts = 3
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// WebhookPayload - состояние карты после эпохи, отправляемое на webhook_url
+type WebhookPayload struct {
+	MapID   int    `json:"map_id"`
+	Epoch   int    `json:"epoch"`
+	Numbers int    `json:"numbers"`
+	Cells   []Cell `json:"cells"`
+}
+
+// notifyWebhook отправляет состояние карты на webhook_url в фоне, не блокируя
+// ответ. Неудачные попытки повторяются с растущей паузой.
+func notifyWebhook(webhookURL string, mapID, epoch int, cells []Cell) {
+	if webhookURL == "" {
+		return
+	}
+	numbers := 0
+	for _, cell := range cells {
+		numbers += len(cell.Vals)
+	}
+	body, err := json.Marshal(WebhookPayload{mapID, epoch, numbers, cells})
+	if err != nil {
+		mapLogf(mapID, "⚠️  Webhook карты %d: ошибка сериализации: %v", mapID, err)
+		return
+	}
+
+	go func() {
+		for attempt := 1; attempt <= webhookAttempts; attempt++ {
+			resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode < 300 {
+					mapLogf(mapID, "📨 Webhook карты %d: эпоха %d доставлена (%d)", mapID, epoch, resp.StatusCode)
+					return
+				}
+				err = fmt.Errorf("статус %d", resp.StatusCode)
+			}
+			mapLogf(mapID, "⚠️  Webhook карты %d: попытка %d/%d не удалась: %v", mapID, attempt, webhookAttempts, err)
+			if attempt < webhookAttempts {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+		}
+		mapLogf(mapID, "❌ Webhook карты %d: эпоха %d не доставлена", mapID, epoch)
+	}()
+}
+
+// mapLogCapacity - сколько последних строк лога хранится для каждой карты
+const mapLogCapacity = 200
+
+// maxLoggedMaps - для скольких карт хранятся логи; при превышении
+// удаляется буфер карты, дольше всех не писавшей в лог
+const maxLoggedMaps = 1000
+
+// MapLogEntry - строка лога операции с картой
+type MapLogEntry struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// mapLogStore хранит кольцевые буферы строк лога по картам
+type mapLogStore struct {
+	mu     sync.Mutex
+	lines  map[int][]MapLogEntry
+	recent []int // карты в порядке последней записи
+}
+
+var mapLogs = &mapLogStore{lines: make(map[int][]MapLogEntry)}
+
+func (s *mapLogStore) add(mapID int, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, id := range s.recent {
+		if id == mapID {
+			s.recent = append(s.recent[:i], s.recent[i+1:]...)
+			break
+		}
+	}
+	s.recent = append(s.recent, mapID)
+	if len(s.recent) > maxLoggedMaps {
+		delete(s.lines, s.recent[0])
+		s.recent = s.recent[1:]
+	}
+
+	lines := append(s.lines[mapID], MapLogEntry{time.Now(), message})
+	if len(lines) > mapLogCapacity {
+		lines = append([]MapLogEntry{}, lines[len(lines)-mapLogCapacity:]...)
+	}
+	s.lines[mapID] = lines
+}
+
+func (s *mapLogStore) get(mapID int) []MapLogEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]MapLogEntry{}, s.lines[mapID]...)
+}
+
+// mapLogf пишет строку в общий лог и в буфер лога карты
+func mapLogf(mapID int, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.Print(message)
+	mapLogs.add(mapID, message)
+}
+
+// mapLogsHandler возвращает последние строки лога операций с картой
+func mapLogsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	var exists int
+	err = db.QueryRow("SELECT COUNT(*) FROM maps WHERE id = ? AND deleted_at IS NULL", mapID).Scan(&exists)
+	if err != nil || exists == 0 {
+		writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		return
+	}
+
+	resp := struct {
+		MapID int           `json:"map_id"`
+		Logs  []MapLogEntry `json:"logs"`
+	}{mapID, mapLogs.get(mapID)}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// mapIDFromPath извлекает ID карты из URL вида /api/maps/{id}/...
+func mapIDFromPath(r *http.Request) (int, error) {
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 4 {
+		return 0, fmt.Errorf("некорректный URL")
+	}
+	return strconv.Atoi(pathParts[3])
+}
+
+func territoriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	cfg, circles, err := loadMapGeometry(mapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	resp := struct {
+		MapID       int      `json:"map_id"`
+		Width       int      `json:"width"`
+		Height      int      `json:"height"`
+		Circles     []Circle `json:"circles"`
+		Territories [][]int  `json:"territories"`
+	}{mapID, cfg.Width, cfg.Height, circles, computeTerritories(cfg, circles)}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// Page - страница списка с метаданными пагинации
+type Page struct {
+	Total  int         `json:"total"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+	Items  interface{} `json:"items"`
+}
+
+// parsePagination читает параметры limit/offset из query-строки
+func parsePagination(r *http.Request) (limit, offset int, err error) {
+	limit = defaultPageLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return 0, 0, fmt.Errorf("limit должен быть положительным числом")
+		}
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset не может быть отрицательным")
+		}
+	}
+	return limit, offset, nil
+}
+
+const maxCellPageLimit = 10000
+
+// cellCursorPrefix - версия формата курсора клеток
+const cellCursorPrefix = "c1:"
+
+// encodeCellCursor кодирует позицию последней отданной клетки (y, x, слой) в курсор
+func encodeCellCursor(x, y, layer int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s%d:%d:%d", cellCursorPrefix, y, x, layer)))
+}
+
+// decodeCellCursor разбирает курсор, созданный encodeCellCursor.
+// Курсоры без слоя (y:x) относятся к слою 0.
+func decodeCellCursor(cursor string) (x, y, layer int, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(raw), cellCursorPrefix) {
+		return 0, 0, 0, fmt.Errorf("некорректный курсор")
+	}
+	parts := strings.Split(strings.TrimPrefix(string(raw), cellCursorPrefix), ":")
+	if len(parts) != 2 && len(parts) != 3 {
+		return 0, 0, 0, fmt.Errorf("некорректный курсор")
+	}
+	if y, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, 0, fmt.Errorf("некорректный курсор")
+	}
+	if x, err = strconv.Atoi(parts[1]); err != nil {
+		return 0, 0, 0, fmt.Errorf("некорректный курсор")
+	}
+	if len(parts) == 3 {
+		if layer, err = strconv.Atoi(parts[2]); err != nil {
+			return 0, 0, 0, fmt.Errorf("некорректный курсор")
+		}
+	}
+	return x, y, layer, nil
+}
+
+// cellPage - параметры постраничной выдачи клеток ?cursor=&limit=
+type cellPage struct {
+	limit     int
+	hasCursor bool
+	x, y      int // последняя отданная клетка
+	layer     int
+}
+
+// parseCellPage читает параметры страницы клеток. Возвращает nil,
+// если ни limit, ни cursor не заданы (выдача всех клеток).
+func parseCellPage(r *http.Request) (*cellPage, error) {
+	query := r.URL.Query()
+	limitStr, cursor := query.Get("limit"), query.Get("cursor")
+	if limitStr == "" && cursor == "" {
+		return nil, nil
+	}
+
+	p := &cellPage{limit: defaultPageLimit}
+	if limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxCellPageLimit {
+			return nil, fmt.Errorf("limit должен быть от 1 до %d", maxCellPageLimit)
+		}
+		p.limit = limit
+	}
+	if cursor != "" {
+		x, y, layer, err := decodeCellCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		p.hasCursor, p.x, p.y, p.layer = true, x, y, layer
+	}
+	return p, nil
+}
+
+// apply возвращает страницу клеток, упорядоченных по y, затем x, и курсор
+// следующей страницы (пустой на последней). Для nil возвращает все клетки.
+func (p *cellPage) apply(cells []Cell) ([]Cell, string) {
+	if p == nil {
+		return cells, ""
+	}
+
+	sorted := make([]Cell, len(cells))
+	copy(sorted, cells)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Y != sorted[j].Y {
+			return sorted[i].Y < sorted[j].Y
+		}
+		if sorted[i].X != sorted[j].X {
+			return sorted[i].X < sorted[j].X
+		}
+		return sorted[i].Layer < sorted[j].Layer
+	})
+
+	start := 0
+	if p.hasCursor {
+		start = sort.Search(len(sorted), func(i int) bool {
+			c := sorted[i]
+			if c.Y != p.y {
+				return c.Y > p.y
+			}
+			if c.X != p.x {
+				return c.X > p.x
+			}
+			return c.Layer > p.layer
+		})
+	}
+
+	end := start + p.limit
+	if end >= len(sorted) {
+		return sorted[start:], ""
+	}
+	last := sorted[end-1]
+	return sorted[start:end], encodeCellCursor(last.X, last.Y, last.Layer)
+}
+
+// cellsHandler возвращает клетки карты, при заданных ?limit=&cursor= - постранично.
+// Ответы /api/distribute и /api/newEpoch поддерживают те же параметры,
+// следующие страницы запрашиваются здесь.
+func cellsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	pageParams, err := parseCellPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var exists int
+	err = db.QueryRow("SELECT COUNT(*) FROM maps WHERE id = ? AND deleted_at IS NULL", mapID).Scan(&exists)
+	if err != nil || exists == 0 {
+		writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		return
+	}
+
+	cells, err := loadCellsFromDB(mapID)
+	if err != nil {
+		http.Error(w, "Ошибка загрузки клеток: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page, next := pageParams.apply(cells)
+
+	resp := struct {
+		MapID      int    `json:"map_id"`
+		Cells      []Cell `json:"cells"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	}{mapID, page, next}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// LayoutMetrics - геометрические характеристики раскладки кругов одной карты
+type LayoutMetrics struct {
+	MapID       int     `json:"map_id"`
+	Circles     int     `json:"circles"`
+	NearestDist float64 `json:"mean_nearest_distance"` // среднее расстояние до ближайшего соседа
+	Coverage    float64 `json:"coverage"`
+}
+
+// compareMapsHandler сравнивает раскладки кругов двух карт ?a=&b=
+func compareMapsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	ids := [2]int{}
+	for i, name := range []string{"a", "b"} {
+		id, err := strconv.Atoi(query.Get(name))
+		if err != nil {
+			http.Error(w, "Некорректный параметр "+name, http.StatusBadRequest)
+			return
+		}
+		ids[i] = id
+	}
+
+	var metrics [2]LayoutMetrics
+	var circles [2][]Circle
+	for i, id := range ids {
+		cfg, c, err := loadMapGeometry(id)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, fmt.Sprintf("Карта %d не найдена", id))
+			} else {
+				http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		circles[i] = c
+		metrics[i] = LayoutMetrics{
+			MapID:       id,
+			Circles:     len(c),
+			NearestDist: meanNearestDistance(c, c, true),
+			Coverage:    computeCoverage(cfg, c),
+		}
+	}
+
+	// Симметричное среднее расстояние от кругов одной карты до ближайших кругов другой
+	crossDist := (meanNearestDistance(circles[0], circles[1], false) +
+		meanNearestDistance(circles[1], circles[0], false)) / 2
+
+	resp := struct {
+		A                LayoutMetrics `json:"a"`
+		B                LayoutMetrics `json:"b"`
+		CircleCountDiff  int           `json:"circle_count_diff"`
+		NearestDistDiff  float64       `json:"mean_nearest_distance_diff"`
+		CoverageDiff     float64       `json:"coverage_diff"`
+		CrossNearestDist float64       `json:"cross_nearest_distance"`
+	}{
+		A:                metrics[0],
+		B:                metrics[1],
+		CircleCountDiff:  metrics[1].Circles - metrics[0].Circles,
+		NearestDistDiff:  metrics[1].NearestDist - metrics[0].NearestDist,
+		CoverageDiff:     metrics[1].Coverage - metrics[0].Coverage,
+		CrossNearestDist: crossDist,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// escapeLike экранирует спецсимволы шаблона LIKE (используется с ESCAPE '\')
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func searchMapsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, "Некорректная пагинация: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q := escapeLike(r.URL.Query().Get("q"))
+	var total int
+	err = db.QueryRow(`SELECT COUNT(*) FROM maps WHERE deleted_at IS NULL AND name LIKE '%' || ? || '%' ESCAPE '\'`, q).Scan(&total)
+	if err != nil {
+		http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rows, err := db.Query(`SELECT id, name, COALESCE(epoch, 0), created_at FROM maps
+		WHERE deleted_at IS NULL AND name LIKE '%' || ? || '%' ESCAPE '\'
+		ORDER BY id LIMIT ? OFFSET ?`, q, limit, offset)
+	if err != nil {
+		http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	maps := []MapSummary{}
+	for rows.Next() {
+		var m MapSummary
+		if err := rows.Scan(&m.ID, &m.Name, &m.Epoch, &m.Created); err != nil {
+			http.Error(w, "Ошибка чтения карты: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		maps = append(maps, m)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Page{total, limit, offset, maps})
+}
+
+func fingerprintHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	var epoch sql.NullInt64
+	err = db.QueryRow("SELECT epoch FROM maps WHERE id = ? AND deleted_at IS NULL", mapID).Scan(&epoch)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	cells, err := loadCellsFromDB(mapID)
+	if err != nil {
+		http.Error(w, "Ошибка загрузки клеток: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fingerprint := mapFingerprint(int(epoch.Int64), cells)
+	etag := `"` + fingerprint + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	resp := struct {
+		MapID       int    `json:"map_id"`
+		Epoch       int    `json:"epoch"`
+		Fingerprint string `json:"fingerprint"`
+	}{mapID, int(epoch.Int64), fingerprint}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// EpochStep - параметры одной эпохи карты
+type EpochStep struct {
+	Move   MoveOptions
+	Decay  float64 // вероятность исчезновения числа за эпоху
+	MaxAge int     // возраст, после которого число умирает (0 - без ограничения)
+}
+
+// runEpochStep выполняет одну эпоху над клетками карты m: движение каждого слоя
+// со своими скоростями, затем исчезновение и старение чисел. Состояние не сохраняется.
+// stats равен nil, если скорости не заданы ни для одного слоя.
+func runEpochStep(rng *rand.Rand, m Map, cells []Cell, step EpochStep) (moved []Cell, stats *MoveStats, decayed, died int, err error) {
+	layerSpeeds, err := loadLayerSpeeds(m.ID)
+	if err != nil {
+		return nil, nil, 0, 0, fmt.Errorf("загрузка скоростей слоев: %v", err)
+	}
+	moved, stats = moveLayers(rng, m.Config, m.Circles, cells, m.Speeds, layerSpeeds, step.Move)
+	if step.Decay > 0 {
+		moved, decayed = decayCells(rng, moved, step.Decay)
+	}
+	if step.MaxAge > 0 {
+		moved, died = ageCells(moved, step.MaxAge)
+	}
+	return moved, stats, decayed, died, nil
+}
+
+// mapLockStore выдает мьютекс каждой карты. Все изменяющие пути (эпохи, тики,
+// задачи, распределение, правка клеток и кругов) держат его на всем цикле
+// загрузка → изменение → сохранение, чтобы не затирать чужие изменения.
+type mapLockStore struct {
+	mu    sync.Mutex
+	locks map[int]*sync.Mutex
+}
+
+var mapLocks = &mapLockStore{locks: make(map[int]*sync.Mutex)}
+
+// lock захватывает мьютекс карты и возвращает функцию его освобождения
+func (s *mapLockStore) lock(mapID int) func() {
+	s.mu.Lock()
+	l, ok := s.locks[mapID]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[mapID] = l
+	}
+	s.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// saveEpoch сохраняет эпоху epoch карты m в одной транзакции: номер эпохи,
+// изменившиеся клетки (при ошибке - полная перезапись) и снимок для config.history.
+// После коммита состояние отправляется на webhook_url.
+func saveEpoch(m Map, epoch int, cells []Cell) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("начало транзакции: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE maps SET epoch = ? WHERE id = ?", epoch, m.ID); err != nil {
+		return fmt.Errorf("обновление эпохи: %v", err)
+	}
+	inserted, updated, deleted, err := saveCellsDiffTx(tx, m.ID, cells)
+	if err != nil {
+		log.Printf("⚠️  Ошибка инкрементального сохранения, полная перезапись: %v", err)
+		if err := saveCellsTx(tx, m.ID, cells); err != nil {
+			return err
+		}
+	} else {
+		mapLogf(m.ID, "💾 Карта %d: +%d ~%d -%d клеток", m.ID, inserted, updated, deleted)
+	}
+	if m.Config.History {
+		if err := saveHistorySnapshot(tx, m.ID, epoch, cells); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("коммит транзакции: %v", err)
+	}
+	notifyWebhook(m.Config.WebhookURL, m.ID, epoch, cells)
+	return nil
+}
+
+// tickMap выполняет одну эпоху движения для карты в отдельной транзакции
+// и возвращает новый номер эпохи
+func tickMap(mapID int) (int, []Cell, error) {
+	unlock := mapLocks.lock(mapID)
+	defer unlock()
+
+	m, err := loadMap(mapID)
+	if err != nil {
+		return 0, nil, fmt.Errorf("получение карты: %v", err)
+	}
+	cells, err := loadCellsForUpdate(db, mapID)
+	if err != nil {
+		return 0, nil, err
+	}
+	cells, _, _, _, err = runEpochStep(newRNG(), m, cells, EpochStep{})
+	if err != nil {
+		return 0, nil, err
+	}
+	newEpoch := m.Epoch + 1
+	if err := saveEpoch(m, newEpoch, cells); err != nil {
+		return 0, nil, err
+	}
+	return newEpoch, cells, nil
+}
+
+func tickHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := db.Query("SELECT id FROM maps WHERE deleted_at IS NULL AND speeds IS NOT NULL AND speeds != '' AND speeds != '[]' ORDER BY id")
+	if err != nil {
+		http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mapIDs := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			http.Error(w, "Ошибка чтения карты: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		mapIDs = append(mapIDs, id)
+	}
+	rows.Close()
+
+	type tickResult struct {
+		MapID int    `json:"map_id"`
+		Epoch int    `json:"epoch"`
+		Error string `json:"error,omitempty"`
+	}
+	results := []tickResult{}
+	for _, id := range mapIDs {
+		epoch, _, err := tickMap(id)
+		if err != nil {
+			mapLogf(id, "❌ Тик карты %d: %v", id, err)
+			results = append(results, tickResult{MapID: id, Error: err.Error()})
+			continue
+		}
+		results = append(results, tickResult{MapID: id, Epoch: epoch})
+	}
+	log.Printf("⏱️  Глобальный тик: обработано карт %d", len(results))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// findTrappedCells возвращает занятые клетки, у которых нет ни одного соседа,
+// способного принять число: все соседи - центры кругов или клетки с нулевой
+// вместимостью, включая стену рамки. Числа в таких клетках не могут сдвинуться ни при какой скорости.
+func findTrappedCells(cfg Config, circles []Circle, cells []Cell) []Cell {
+	trapped := []Cell{}
+	for _, cell := range cells {
+		if len(cell.Vals) == 0 {
+			continue
+		}
+		passable := false
+		for _, n := range getNeighbors(cell.X, cell.Y, cfg, cfg.Neighborhood) {
+			if !impassable(getCellType(n.X, n.Y, circles, cfg)) && cellCapacityAt(cfg, circles, n.X, n.Y) > 0 {
+				passable = true
+				break
+			}
+		}
+		if !passable {
+			trapped = append(trapped, cell)
+		}
+	}
+	return trapped
+}
+
+func trappedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	cfg, circles, err := loadMapGeometry(mapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	cells, err := loadCellsFromDB(mapID)
+	if err != nil {
+		http.Error(w, "Ошибка загрузки клеток: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	trapped := findTrappedCells(cfg, circles, cells)
+	numbers := 0
+	for _, cell := range trapped {
+		numbers += len(cell.Vals)
+	}
+
+	resp := struct {
+		MapID   int    `json:"map_id"`
+		Count   int    `json:"count"`
+		Numbers int    `json:"numbers"` // чисел в запертых клетках
+		Cells   []Cell `json:"cells"`
+	}{mapID, len(trapped), numbers, trapped}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func boundsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	cfg, _, err := loadMapGeometry(mapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var count int
+	var minX, minY, maxX, maxY sql.NullInt64
+	err = db.QueryRow("SELECT COUNT(*), MIN(x), MIN(y), MAX(x), MAX(y) FROM map_cells WHERE map_id = ?", mapID).
+		Scan(&count, &minX, &minY, &maxX, &maxY)
+	if err != nil {
+		http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		MapID int  `json:"map_id"`
+		MinX  int  `json:"min_x"`
+		MinY  int  `json:"min_y"`
+		MaxX  int  `json:"max_x"`
+		MaxY  int  `json:"max_y"`
+		Empty bool `json:"empty"`
+	}{MapID: mapID}
+
+	if count == 0 {
+		// Клеток нет - возвращаем границы всей карты
+		resp.MaxX, resp.MaxY, resp.Empty = cfg.Width-1, cfg.Height-1, true
+	} else {
+		resp.MinX, resp.MinY = int(minX.Int64), int(minY.Int64)
+		resp.MaxX, resp.MaxY = int(maxX.Int64), int(maxY.Int64)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// updateCircles сохраняет новые круги карты и приводит клетки к новой геометрии.
+// Клетки читаются и перезаписываются в одной транзакции; вызывающий держит
+// блокировку карты (mapLocks).
+func updateCircles(mapID int, cfg Config, circles []Circle) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("начало транзакции: %v", err)
+	}
+	defer tx.Rollback()
+
+	cells, err := loadCellsForUpdate(tx, mapID)
+	if err != nil {
+		return 0, err
+	}
+	cells, dropped := sanitizeCells(cfg, circles, cells)
+
+	circlesBytes, _ := json.Marshal(circles)
+	if _, err := tx.Exec("UPDATE maps SET circles = ? WHERE id = ?", string(circlesBytes), mapID); err != nil {
+		return 0, fmt.Errorf("обновление кругов: %v", err)
+	}
+	if err := saveCellsTx(tx, mapID, cells); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("коммит транзакции: %v", err)
+	}
+	return dropped, nil
+}
+
+// getCirclesHandler возвращает конфигурацию и круги карты без загрузки клеток
+func getCirclesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	cfg, circles, err := loadMapGeometry(mapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	resp := struct {
+		MapID   int      `json:"map_id"`
+		Config  Config   `json:"config"`
+		Circles []Circle `json:"circles"`
+	}{mapID, cfg, circles}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func addCircleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	var circle Circle
+	if err := decodeJSON(r, &circle); err != nil {
+		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if circle.Type == "" {
+		circle.Type = "bedroom"
+	}
+	if circle.Type != "spawn" && circle.Type != "bedroom" {
+		http.Error(w, fmt.Sprintf("Тип круга должен быть spawn или bedroom, получено %q", circle.Type), http.StatusBadRequest)
+		return
+	}
+	if circle.Radius < 0 {
+		http.Error(w, "Радиус не может быть отрицательным", http.StatusBadRequest)
+		return
+	}
+
+	unlock := mapLocks.lock(mapID)
+	defer unlock()
+
+	cfg, circles, err := loadMapGeometry(mapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if cfg.CenterRadius > 0 && circle.Radius <= cfg.CenterRadius {
+		http.Error(w, fmt.Sprintf("Радиус %d должен быть больше center_radius=%d", circle.Radius, cfg.CenterRadius),
+			http.StatusBadRequest)
+		return
+	}
+
+	if !canPlaceAmong(cfg, circles, circle) {
+		http.Error(w, "Круг выходит за границы карты или пересекает существующие", http.StatusConflict)
+		return
+	}
+
+	circles = append(circles, circle)
+	dropped, err := updateCircles(mapID, cfg, circles)
+	if err != nil {
+		http.Error(w, "Ошибка сохранения кругов: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mapLogf(mapID, "➕ Карта %d: добавлен круг %s (%d, %d), удалено чисел: %d", mapID, circle.Type, circle.X, circle.Y, dropped)
+
+	resp := struct {
+		MapID   int      `json:"map_id"`
+		Index   int      `json:"index"`
+		Circles []Circle `json:"circles"`
+		Dropped int      `json:"dropped_values"`
+	}{mapID, len(circles) - 1, circles, dropped}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func deleteCircleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// URL вида /api/maps/{id}/circles/{index}
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 6 {
+		http.Error(w, "Некорректный URL", http.StatusBadRequest)
+		return
+	}
+	mapID, err := strconv.Atoi(pathParts[3])
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+	index, err := strconv.Atoi(pathParts[5])
+	if err != nil {
+		http.Error(w, "Некорректный индекс круга", http.StatusBadRequest)
+		return
+	}
+
+	unlock := mapLocks.lock(mapID)
+	defer unlock()
+
+	cfg, circles, err := loadMapGeometry(mapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if index < 0 || index >= len(circles) {
+		http.Error(w, "Круг не найден", http.StatusNotFound)
+		return
+	}
+
+	removed := circles[index]
+	circles = append(circles[:index], circles[index+1:]...)
+	dropped, err := updateCircles(mapID, cfg, circles)
+	if err != nil {
+		http.Error(w, "Ошибка сохранения кругов: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mapLogf(mapID, "➖ Карта %d: удален круг %d (%s)", mapID, index, removed.Type)
+
+	resp := struct {
+		MapID   int      `json:"map_id"`
+		Removed Circle   `json:"removed"`
+		Circles []Circle `json:"circles"`
+		Dropped int      `json:"dropped_values"`
+	}{mapID, removed, circles, dropped}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Job - фоновая задача прогона эпох
+type Job struct {
+	ID       int        `json:"id"`
+	MapID    int        `json:"map_id"`
+	Total    int        `json:"total"`
+	Done     int        `json:"done"`
+	Status   string     `json:"status"` // running, done, failed, cancelled
+	Error    string     `json:"error,omitempty"`
+	Started  time.Time  `json:"started_at"`
+	Finished *time.Time `json:"finished_at,omitempty"`
+
+	cancel bool // запрошена отмена; задача остановится перед следующей эпохой
+}
+
+// jobStore хранит состояние фоновых задач в памяти
+type jobStore struct {
+	mu     sync.Mutex
+	nextID int
+	jobs   map[int]*Job
+}
+
+var jobs = &jobStore{jobs: make(map[int]*Job)}
+
+const maxJobEpochs = 100000
+
+// Завершенные задачи хранятся не дольше finishedJobTTL и не больше maxFinishedJobs штук
+const (
+	finishedJobTTL  = time.Hour
+	maxFinishedJobs = 1000
+)
+
+// Ограничения синхронного прогона с промежуточными состояниями (return_intermediate):
+// число эпох и суммарное число клеток во всех возвращаемых кадрах
+const (
+	maxIntermediateEpochs = 200
+	maxIntermediateCells  = 200000
+)
+
+func (s *jobStore) create(mapID, total int) *Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evictFinished(time.Now())
+	s.nextID++
+	job := &Job{ID: s.nextID, MapID: mapID, Total: total, Status: "running", Started: time.Now()}
+	s.jobs[job.ID] = job
+	return job
+}
+
+// evictFinished удаляет завершенные задачи старше finishedJobTTL, а затем самые
+// старые из оставшихся сверх maxFinishedJobs. Выполняющиеся задачи не трогаются.
+// Вызывается под s.mu.
+func (s *jobStore) evictFinished(now time.Time) {
+	finished := []*Job{}
+	for id, job := range s.jobs {
+		if job.Finished == nil {
+			continue
+		}
+		if now.Sub(*job.Finished) > finishedJobTTL {
+			delete(s.jobs, id)
+			continue
+		}
+		finished = append(finished, job)
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].Finished.Before(*finished[j].Finished) })
+	for _, job := range finished[:len(finished)-maxFinishedJobs] {
+		delete(s.jobs, job.ID)
+	}
+}
+
+// get возвращает копию задачи, чтобы её можно было безопасно сериализовать
+func (s *jobStore) get(id int) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+func (s *jobStore) update(id int, fn func(job *Job)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.jobs[id]; ok {
+		fn(job)
+	}
+}
+
+// requestCancel помечает выполняющуюся задачу для отмены. Возвращает копию задачи;
+// false, если задачи нет, и ошибку, если она уже завершена.
+func (s *jobStore) requestCancel(id int) (Job, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false, nil
+	}
+	if job.Finished != nil {
+		return *job, true, fmt.Errorf("задача уже завершена со статусом %s", job.Status)
+	}
+	job.cancel = true
+	return *job, true, nil
+}
+
+// runEpochsJob последовательно выполняет эпохи карты и обновляет прогресс задачи.
+// Отмена проверяется между эпохами: начатая эпоха всегда сохраняется целиком.
+func runEpochsJob(jobID, mapID, total int) {
+	for i := 0; i < total; i++ {
+		if job, _ := jobs.get(jobID); job.cancel {
+			jobs.update(jobID, func(job *Job) {
+				now := time.Now()
+				job.Status, job.Finished = "cancelled", &now
+			})
+			mapLogf(mapID, "⏹️  Задача %d: отменена после %d из %d эпох карты %d", jobID, i, total, mapID)
+			return
+		}
+		if _, _, err := tickMap(mapID); err != nil {
+			mapLogf(mapID, "❌ Задача %d: эпоха %d карты %d: %v", jobID, i+1, mapID, err)
+			jobs.update(jobID, func(job *Job) {
+				now := time.Now()
+				job.Status, job.Error, job.Finished = "failed", err.Error(), &now
+			})
+			return
+		}
+		jobs.update(jobID, func(job *Job) { job.Done = i + 1 })
+	}
+	jobs.update(jobID, func(job *Job) {
+		now := time.Now()
+		job.Status, job.Finished = "done", &now
+	})
+	mapLogf(mapID, "✅ Задача %d: выполнено %d эпох карты %d", jobID, total, mapID)
+}
+
+func runEpochsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Epochs int `json:"epochs"`
+		// Выполнить эпохи синхронно и вернуть состояние клеток после каждой
+		ReturnIntermediate bool `json:"return_intermediate"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Epochs <= 0 || req.Epochs > maxJobEpochs {
+		http.Error(w, fmt.Sprintf("epochs должен быть от 1 до %d", maxJobEpochs), http.StatusBadRequest)
+		return
+	}
+	if req.ReturnIntermediate && req.Epochs > maxIntermediateEpochs {
+		http.Error(w, fmt.Sprintf("С return_intermediate epochs должен быть от 1 до %d", maxIntermediateEpochs), http.StatusBadRequest)
+		return
+	}
+
+	var exists int
+	err = db.QueryRow("SELECT COUNT(*) FROM maps WHERE id = ? AND deleted_at IS NULL", mapID).Scan(&exists)
+	if err != nil || exists == 0 {
+		writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		return
+	}
+
+	if req.ReturnIntermediate {
+		runIntermediateEpochs(w, mapID, req.Epochs)
+		return
+	}
+
+	job := jobs.create(mapID, req.Epochs)
+	go runEpochsJob(job.ID, mapID, req.Epochs)
+	mapLogf(mapID, "🏃 Задача %d: запуск %d эпох карты %d", job.ID, req.Epochs, mapID)
+
+	snapshot, _ := jobs.get(job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// runIntermediateEpochs выполняет epochs эпох карты в рамках запроса и возвращает
+// снимок клеток после каждой. Движение не меняет количество чисел, поэтому
+// размер ответа оценивается заранее: в кадре клеток не больше, чем чисел.
+func runIntermediateEpochs(w http.ResponseWriter, mapID, epochs int) {
+	cells, err := loadCellsFromDB(mapID)
+	if err != nil {
+		http.Error(w, "Ошибка загрузки клеток: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	numbers := 0
+	for _, cell := range cells {
+		numbers += len(cell.Vals)
+	}
+	if numbers*epochs > maxIntermediateCells {
+		http.Error(w, fmt.Sprintf("Слишком большой ответ: до %d клеток за %d эпох (max %d), уменьшите epochs",
+			numbers*epochs, epochs, maxIntermediateCells), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	frames := make([]HistoryFrame, 0, epochs)
+	for i := 0; i < epochs; i++ {
+		epoch, cells, err := tickMap(mapID)
+		if err != nil {
+			mapLogf(mapID, "❌ Прогон карты %d: эпоха %d из %d: %v", mapID, i+1, epochs, err)
+			http.Error(w, fmt.Sprintf("Ошибка эпохи %d из %d (предыдущие сохранены): %v", i+1, epochs, err),
+				http.StatusInternalServerError)
+			return
+		}
+		frames = append(frames, HistoryFrame{Epoch: epoch, Cells: cells})
+	}
+	mapLogf(mapID, "🎞️  Карта %d: выполнено %d эпох с промежуточными состояниями", mapID, epochs)
+
+	resp := struct {
+		MapID  int            `json:"map_id"`
+		Epoch  int            `json:"epoch"`
+		Frames []HistoryFrame `json:"frames"`
+	}{mapID, frames[len(frames)-1].Epoch, frames}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// debugMode включает отладочные эндпоинты (флаг -debug)
+var debugMode bool
+
+const (
+	defaultConvergeEpochs = 100
+	maxConvergeEpochs     = 10000
+)
+
+// convergeHandler прогоняет эпохи движения в памяти, пока состояние клеток
+// не перестанет меняться stable_epochs эпох подряд или не будет достигнут max_epochs.
+// Состояние карты в БД не изменяется. Доступен только с флагом -debug.
+func convergeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		MaxEpochs    int    `json:"max_epochs"`
+		StableEpochs int    `json:"stable_epochs"` // сколько эпох подряд состояние не должно меняться
+		Seed         *int64 `json:"seed"`          // зерно для воспроизводимого прогона
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.MaxEpochs == 0 {
+		req.MaxEpochs = defaultConvergeEpochs
+	}
+	if req.StableEpochs == 0 {
+		req.StableEpochs = 1
+	}
+	if req.MaxEpochs < 0 || req.MaxEpochs > maxConvergeEpochs {
+		http.Error(w, fmt.Sprintf("max_epochs должен быть от 1 до %d", maxConvergeEpochs), http.StatusBadRequest)
+		return
+	}
+	if req.StableEpochs < 0 || req.StableEpochs > req.MaxEpochs {
+		http.Error(w, "stable_epochs должен быть от 1 до max_epochs", http.StatusBadRequest)
+		return
+	}
+
+	m, err := loadMap(mapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	cells, err := loadCellsFromDB(mapID)
+	if err != nil {
+		http.Error(w, "Ошибка загрузки клеток: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	layerSpeeds, err := loadLayerSpeeds(mapID)
+	if err != nil {
+		http.Error(w, "Ошибка загрузки скоростей слоев: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rng := newRNG()
+	if req.Seed != nil {
+		rng = rand.New(rand.NewSource(*req.Seed))
+	}
+
+	epochs, stable := 0, 0
+	prev := mapFingerprint(0, cells)
+	for epochs < req.MaxEpochs && stable < req.StableEpochs {
+		cells, _ = moveLayers(rng, m.Config, m.Circles, cells, m.Speeds, layerSpeeds, MoveOptions{})
+		epochs++
+		current := mapFingerprint(0, cells)
+		if current == prev {
+			stable++
+		} else {
+			stable = 0
+		}
+		prev = current
+	}
+	converged := stable >= req.StableEpochs
+	mapLogf(mapID, "🧪 Карта %d: сходимость=%v за %d эпох", mapID, converged, epochs)
+
+	resp := struct {
+		MapID     int    `json:"map_id"`
+		Converged bool   `json:"converged"`
+		Epochs    int    `json:"epochs"`
+		Cells     []Cell `json:"cells"`
+	}{mapID, converged, epochs, cells}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func jobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// URL вида /api/jobs/{id}
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 4 {
+		http.Error(w, "Некорректный URL", http.StatusBadRequest)
+		return
+	}
+	jobID, err := strconv.Atoi(pathParts[3])
+	if err != nil {
+		http.Error(w, "Некорректный ID задачи", http.StatusBadRequest)
+		return
+	}
+
+	job, ok := jobs.get(jobID)
+	if !ok {
+		http.Error(w, "Задача не найдена", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// cancelJobHandler запрашивает отмену фоновой задачи. Задача останавливается
+// после текущей эпохи, поэтому ответ 202 и статус меняется на cancelled позже.
+func cancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// URL вида /api/jobs/{id}
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 4 {
+		http.Error(w, "Некорректный URL", http.StatusBadRequest)
+		return
+	}
+	jobID, err := strconv.Atoi(pathParts[3])
+	if err != nil {
+		http.Error(w, "Некорректный ID задачи", http.StatusBadRequest)
+		return
+	}
+
+	job, ok, err := jobs.requestCancel(jobID)
+	if !ok {
+		http.Error(w, "Задача не найдена", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	mapLogf(job.MapID, "⏹️  Задача %d: запрошена отмена", jobID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func undoEpochHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	unlock := mapLocks.lock(mapID)
+	defer unlock()
+
+	m, err := loadMap(mapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if !m.Config.History {
+		http.Error(w, "История эпох не включена для карты (config.history)", http.StatusBadRequest)
+		return
+	}
+	if m.Epoch == 0 {
+		http.Error(w, "Карта уже на начальной эпохе", http.StatusConflict)
+		return
+	}
+
+	prevEpoch := m.Epoch - 1
+	frames, err := loadHistory(mapID, prevEpoch, prevEpoch)
+	if err != nil {
+		http.Error(w, "Ошибка загрузки истории: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(frames) == 0 {
+		http.Error(w, fmt.Sprintf("Снимок эпохи %d не найден", prevEpoch), http.StatusConflict)
+		return
+	}
+	cells := frames[0].Cells
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := saveCellsTx(tx, mapID, cells); err != nil {
+		http.Error(w, "Ошибка восстановления клеток: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("UPDATE maps SET epoch = ? WHERE id = ?", prevEpoch, mapID); err != nil {
+		http.Error(w, "Ошибка обновления эпохи: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM map_history WHERE map_id = ? AND epoch > ?", mapID, prevEpoch); err != nil {
+		http.Error(w, "Ошибка очистки истории: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Ошибка коммита: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mapLogf(mapID, "↩️  Карта %d: откат с эпохи %d на %d", mapID, m.Epoch, prevEpoch)
+
+	resp := struct {
+		MapID int    `json:"map_id"`
+		Epoch int    `json:"epoch"`
+		Cells []Cell `json:"cells"`
+	}{mapID, prevEpoch, cells}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// setCellsHandler заменяет клетки карты явно заданными, проверяя их
+// по типам и вместимости клеток
+func setCellsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Cells []Cell `json:"cells"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	unlock := mapLocks.lock(mapID)
+	defer unlock()
+
+	m, err := loadMap(mapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := validateCells(m.Config, m.Circles, req.Cells); err != nil {
+		http.Error(w, "Некорректные клетки: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Пустые клетки не храним
+	cells := []Cell{}
+	for _, cell := range req.Cells {
+		if len(cell.Vals) > 0 {
+			cells = append(cells, cell)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := saveCellsTx(tx, mapID, cells); err != nil {
+		http.Error(w, "Ошибка сохранения клеток: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Явно заданное состояние заменяет постепенное заполнение
+	if _, err := tx.Exec("UPDATE maps SET fill_state = '' WHERE id = ?", mapID); err != nil {
+		http.Error(w, "Ошибка сброса заполнения: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if m.Config.History {
+		if err := saveHistorySnapshot(tx, mapID, m.Epoch, cells); err != nil {
+			http.Error(w, "Ошибка сохранения истории: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Ошибка коммита: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mapLogf(mapID, "✏️  Карта %d: задано клеток вручную: %d", mapID, len(cells))
+
+	resp := struct {
+		MapID int    `json:"map_id"`
+		Cells []Cell `json:"cells"`
+	}{mapID, cells}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// deleteMapHandler по умолчанию помечает карту удаленной (deleted_at), не трогая данные;
+// с ?hard=true карта и все связанные строки удаляются безвозвратно
+func deleteMapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+	hard := false
+	if v := r.URL.Query().Get("hard"); v != "" {
+		hard, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "Некорректный параметр hard", http.StatusBadRequest)
+			return
+		}
+	}
+
+	unlock := mapLocks.lock(mapID)
+	defer unlock()
+
+	var exists int
+	err = db.QueryRow("SELECT COUNT(*) FROM maps WHERE id = ?", mapID).Scan(&exists)
+	if err != nil {
+		http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if exists == 0 {
+		writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		return
+	}
+
+	if !hard {
+		if _, err := db.Exec("UPDATE maps SET deleted_at = COALESCE(deleted_at, CURRENT_TIMESTAMP) WHERE id = ?", mapID); err != nil {
+			http.Error(w, "Ошибка удаления карты: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		mapLogf(mapID, "🗑️ Карта %d помечена удаленной", mapID)
+	} else {
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		tables := append([]string{"players", "idempotency_keys"}, orphanTables...)
+		for _, table := range tables {
+			if _, err := tx.Exec("DELETE FROM "+table+" WHERE map_id = ?", mapID); err != nil {
+				http.Error(w, "Ошибка очистки "+table+": "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if _, err := tx.Exec("DELETE FROM maps WHERE id = ?", mapID); err != nil {
+			http.Error(w, "Ошибка удаления карты: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Ошибка коммита: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		mapLogf(mapID, "🗑️ Карта %d удалена безвозвратно", mapID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"map_id": mapID, "deleted": true, "hard": hard})
+}
+
+// restoreMapHandler снимает пометку мягкого удаления
+func restoreMapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	unlock := mapLocks.lock(mapID)
+	defer unlock()
+
+	var deletedAt sql.NullString
+	err = db.QueryRow("SELECT deleted_at FROM maps WHERE id = ?", mapID).Scan(&deletedAt)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		return
+	}
+	if err != nil {
+		http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deletedAt.Valid {
+		http.Error(w, "Карта не удалена", http.StatusConflict)
+		return
+	}
+
+	if _, err := db.Exec("UPDATE maps SET deleted_at = NULL WHERE id = ?", mapID); err != nil {
+		http.Error(w, "Ошибка восстановления карты: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mapLogf(mapID, "♻️ Карта %d восстановлена", mapID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"map_id": mapID, "restored": true})
+}
+
+// regenerateHandler заново генерирует круги карты по сохраненной конфигурации
+// (с заданным или случайным зерном), очищает клетки, историю и сбрасывает эпоху
+func regenerateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	// Тело необязательно
+	var req struct {
+		Seed *int64 `json:"seed"`
+	}
+	if err := decodeJSON(r, &req); err != nil && err != io.EOF {
+		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	seed := time.Now().UnixNano()
+	if req.Seed != nil {
+		seed = *req.Seed
+	}
+
+	unlock := mapLocks.lock(mapID)
+	defer unlock()
+
+	cfg, _, err := loadMapGeometry(mapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	gen := NewMapGenerator(cfg)
+	gen.rng = rand.New(rand.NewSource(seed))
+	if err := gen.Generate(); err != nil {
+		http.Error(w, "Ошибка генерации: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	circles := gen.getAllCircles()
+	circlesBytes, _ := json.Marshal(circles)
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE maps SET circles = ?, epoch = 0, fill_state = '' WHERE id = ?", string(circlesBytes), mapID); err != nil {
+		http.Error(w, "Ошибка сохранения кругов: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Клетки, история и пометки эпох относятся к старой раскладке
+	for _, table := range orphanTables {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE map_id = ?", mapID); err != nil {
+			http.Error(w, "Ошибка очистки "+table+": "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Ошибка коммита: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mapLogf(mapID, "🎲 Карта %d перегенерирована с зерном %d: %d кругов", mapID, seed, len(circles))
+
+	resp := struct {
+		MapID   int      `json:"map_id"`
+		Seed    int64    `json:"seed"`
+		Circles []Circle `json:"circles"`
+		Epoch   int      `json:"epoch"`
+		Warning string   `json:"warning,omitempty"`
+	}{mapID, seed, circles, 0, circlesWarning(circles)}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// recomputeHandler заново классифицирует занятые клетки по текущим кругам
+// и убирает числа, не помещающиеся в клетку нового типа.
+// Параметр ?relocate=true переносит лишние числа в ближайшие свободные клетки вместо удаления.
+func recomputeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	relocate := false
+	if v := r.URL.Query().Get("relocate"); v != "" {
+		relocate, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "Параметр relocate должен быть true или false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	unlock := mapLocks.lock(mapID)
+	defer unlock()
+
+	cfg, circles, err := loadMapGeometry(mapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	cells, err := loadCellsForUpdate(db, mapID)
+	if err != nil {
+		http.Error(w, "Ошибка загрузки клеток: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var relocated, dropped int
+	if relocate {
+		// Каждый слой переносится независимо: слои не делят вместимость клеток
+		layers, byLayer := splitLayers(cells)
+		cells = []Cell{}
+		for _, layer := range layers {
+			layerCells, r, d := relocateCells(cfg, circles, byLayer[layer])
+			cells = append(cells, setLayer(layerCells, layer)...)
+			relocated += r
+			dropped += d
+		}
+	} else {
+		cells, dropped = sanitizeCells(cfg, circles, cells)
+	}
+
+	if err := saveCellsToDB(mapID, cells); err != nil {
+		http.Error(w, "Ошибка сохранения клеток: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mapLogf(mapID, "🧹 Карта %d: пересчет клеток, перенесено: %d, удалено: %d", mapID, relocated, dropped)
+
+	resp := struct {
+		MapID     int    `json:"map_id"`
+		Cells     []Cell `json:"cells"`
+		Relocated int    `json:"relocated_values"`
+		Dropped   int    `json:"dropped_values"`
+	}{mapID, cells, relocated, dropped}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// gridHandler возвращает клетки карты плотной матрицей [y][x].
+// Параметр ?empty= задает представление пустых клеток: "[]" (по умолчанию), "null" или "-1".
+func gridHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	var empty interface{}
+	switch r.URL.Query().Get("empty") {
+	case "", "[]":
+		empty = []int{}
+	case "null":
+		empty = nil
+	case "-1":
+		empty = -1
+	default:
+		http.Error(w, "Параметр empty должен быть [], null или -1", http.StatusBadRequest)
+		return
+	}
+
+	cfg, _, err := loadMapGeometry(mapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	cells, skipped, err := loadCells(db, mapID, r.URL.Query().Get("strict") == "true")
+	if err != nil {
+		http.Error(w, "Ошибка загрузки клеток: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	grid := make([][]interface{}, cfg.Height)
+	for y := range grid {
+		grid[y] = make([]interface{}, cfg.Width)
+		for x := range grid[y] {
+			grid[y][x] = empty
+		}
+	}
+	for _, cell := range cells {
+		if cell.X >= 0 && cell.X < cfg.Width && cell.Y >= 0 && cell.Y < cfg.Height && len(cell.Vals) > 0 {
+			grid[cell.Y][cell.X] = cell.Vals
+		}
+	}
+
+	resp := struct {
+		MapID       int             `json:"map_id"`
+		Width       int             `json:"width"`
+		Height      int             `json:"height"`
+		Grid        [][]interface{} `json:"grid"`
+		SkippedRows int             `json:"skipped_rows"`
+	}{mapID, cfg.Width, cfg.Height, grid, skipped}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// defaultASCIIWidth - ширина текстовой карты по умолчанию; более широкие
+// карты прореживаются блоками одинакового размера по обеим осям
+const defaultASCIIWidth = 120
+
+// asciiSymbol возвращает символ значения: цифру для 0-9 и '+' для больших индексов
+func asciiSymbol(val int) byte {
+	if val >= 0 && val <= 9 {
+		return byte('0' + val)
+	}
+	return '+'
+}
+
+// renderASCII рисует карту текстом: цифра - первое число в клетке, '#' - клетка
+// круга без чисел, '=' - стена рамки, '.' - пустая клетка. При step > 1 каждый
+// символ обозначает блок step x step клеток: числа блока важнее круга, круг - стены.
+// Клетки должны принадлежать одному слою.
+func renderASCII(cfg Config, circles []Circle, cells []Cell, step int) string {
+	values := make(map[string]int)
+	for _, cell := range cells {
+		if len(cell.Vals) > 0 {
+			values[fmt.Sprintf("%d,%d", cell.X, cell.Y)] = cell.Vals[0]
+		}
+	}
+
+	var sb strings.Builder
+	for by := 0; by < cfg.Height; by += step {
+		for bx := 0; bx < cfg.Width; bx += step {
+			symbol := byte('.')
+		block:
+			for y := by; y < by+step && y < cfg.Height; y++ {
+				for x := bx; x < bx+step && x < cfg.Width; x++ {
+					if val, ok := values[fmt.Sprintf("%d,%d", x, y)]; ok {
+						symbol = asciiSymbol(val)
+						break block
+					}
+					switch t := getCellType(x, y, circles, cfg); {
+					case t == 3 && symbol == '.':
+						symbol = '='
+					case t == 1 || t == 2:
+						symbol = '#'
+					}
+				}
+			}
+			sb.WriteByte(symbol)
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+func asciiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	maxWidth := defaultASCIIWidth
+	if v := r.URL.Query().Get("max_width"); v != "" {
+		maxWidth, err = strconv.Atoi(v)
+		if err != nil || maxWidth <= 0 {
+			http.Error(w, "Некорректный параметр max_width", http.StatusBadRequest)
+			return
+		}
+	}
+	layer := 0
+	if v := r.URL.Query().Get("layer"); v != "" {
+		layer, err = strconv.Atoi(v)
+		if err != nil || layer < 0 {
+			http.Error(w, "Некорректный параметр layer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	cfg, circles, err := loadMapGeometry(mapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	cells, err := loadCellsFromDB(mapID)
+	if err != nil {
+		http.Error(w, "Ошибка загрузки клеток: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, byLayer := splitLayers(cells)
+
+	step := (cfg.Width + maxWidth - 1) / maxWidth
+	if step < 1 {
+		step = 1
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, renderASCII(cfg, circles, byLayer[layer], step))
+}
+
+const maxImageUploadBytes = 10 << 20
+
+// distributionFromImage строит распределение по изображению: изображение
+// масштабируется до размеров карты, яркость пикселя определяет индекс числа
+// (от 0 для черного до values-1 для белого). Клетки с нулевой вместимостью
+// (cellCapacityAt) остаются пустыми, в остальные помещается по одному числу.
+func distributionFromImage(cfg Config, circles []Circle, img image.Image, values int) []Cell {
+	cells := []Cell{}
+	bounds := img.Bounds()
+	for y := 0; y < cfg.Height; y++ {
+		for x := 0; x < cfg.Width; x++ {
+			if cellCapacityAt(cfg, circles, x, y) == 0 {
+				continue
+			}
+			px := bounds.Min.X + x*bounds.Dx()/cfg.Width
+			py := bounds.Min.Y + y*bounds.Dy()/cfg.Height
+			gray := color.GrayModel.Convert(img.At(px, py)).(color.Gray)
+			idx := int(gray.Y) * values / 256
+			cells = append(cells, Cell{X: x, Y: y, Vals: []int{idx}})
+		}
+	}
+	return cells
+}
+
+func distributeFromImageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	if ct := r.Header.Get("Content-Type"); ct != "" && ct != "image/png" {
+		http.Error(w, "Неподдерживаемый Content-Type: "+ct+", ожидается image/png", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	values := 2
+	if v := r.URL.Query().Get("values"); v != "" {
+		values, err = strconv.Atoi(v)
+		if err != nil || values < 1 || values > 256 {
+			http.Error(w, "Параметр values должен быть от 1 до 256", http.StatusBadRequest)
+			return
+		}
+	}
+	layer := 0
+	if v := r.URL.Query().Get("layer"); v != "" {
+		layer, err = strconv.Atoi(v)
+		if err != nil || layer < 0 {
+			http.Error(w, "Некорректный параметр layer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	img, err := png.Decode(http.MaxBytesReader(w, r.Body, maxImageUploadBytes))
+	if err != nil {
+		http.Error(w, "Некорректное PNG изображение: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	unlock := mapLocks.lock(mapID)
+	defer unlock()
+
+	m, err := loadMap(mapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	cells := setLayer(distributionFromImage(m.Config, m.Circles, img, values), layer)
+
+	// Клетки других слоев остаются на месте
+	existing, err := loadCellsForUpdate(db, mapID)
+	if err != nil {
+		http.Error(w, "Ошибка загрузки клеток: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	allCells := append([]Cell{}, cells...)
+	for _, cell := range existing {
+		if cell.Layer != layer {
+			allCells = append(allCells, cell)
+		}
+	}
+
+	if err := saveCellsToDB(mapID, allCells); err != nil {
+		http.Error(w, "Ошибка сохранения клеток: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if m.Config.History {
+		if err := saveHistorySnapshot(db, mapID, m.Epoch, allCells); err != nil {
+			log.Printf("⚠️  %v", err)
+		}
+	}
+	mapLogf(mapID, "🖼️  Карта %d: распределение из изображения %dx%d (слой %d)", mapID, img.Bounds().Dx(), img.Bounds().Dy(), layer)
+
+	resp := struct {
+		MapID  int               `json:"map_id"`
+		Cells  []Cell            `json:"cells"`
+		Legend map[string]string `json:"legend"`
+	}{mapID, cells, cellTypeLegend}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// CircleRef - круг вместе с его индексом на карте
+type CircleRef struct {
+	Index  int    `json:"index"`
+	Circle Circle `json:"circle"`
+}
+
+func circleAtHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	x, errX := strconv.Atoi(r.URL.Query().Get("x"))
+	y, errY := strconv.Atoi(r.URL.Query().Get("y"))
+	if errX != nil || errY != nil {
+		http.Error(w, "Параметры x и y обязательны и должны быть числами", http.StatusBadRequest)
+		return
+	}
+
+	cfg, circles, err := loadMapGeometry(mapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if x < 0 || x >= cfg.Width || y < 0 || y >= cfg.Height {
+		http.Error(w, "Клетка вне карты", http.StatusBadRequest)
+		return
+	}
+
+	resp := struct {
+		X        int        `json:"x"`
+		Y        int        `json:"y"`
+		CellType int        `json:"cell_type"`
+		Circle   *CircleRef `json:"circle"`
+		Nearest  *CircleRef `json:"nearest"`
+	}{X: x, Y: y, CellType: getCellType(x, y, circles, cfg)}
+
+	if idx := owningCircle(x, y, circles, cfg); idx >= 0 {
+		resp.Circle = &CircleRef{idx, circles[idx]}
+	}
+	if idx := nearestCircle(x, y, circles); idx >= 0 {
+		resp.Nearest = &CircleRef{idx, circles[idx]}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// dominantValue возвращает самое частое значение в клетке (при равенстве - меньшее)
+func dominantValue(vals []int) int {
+	counts := make(map[int]int)
+	best, bestCount := 0, 0
+	for _, v := range vals {
+		counts[v]++
+		if c := counts[v]; c > bestCount || (c == bestCount && v < best) {
+			best, bestCount = v, c
+		}
+	}
+	return best
+}
+
+// matrixMarketHandler отдает клетки в формате MatrixMarket (coordinate):
+// строка - y+1, столбец - x+1, значение - доминирующий индекс числа в клетке
+func matrixMarketHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	cfg, _, err := loadMapGeometry(mapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	cells, err := loadCellsFromDB(mapID)
+	if err != nil {
+		http.Error(w, "Ошибка загрузки клеток: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	occupied := []Cell{}
+	for _, cell := range cells {
+		if len(cell.Vals) > 0 {
+			occupied = append(occupied, cell)
+		}
+	}
+	sort.Slice(occupied, func(i, j int) bool {
+		if occupied[i].Y != occupied[j].Y {
+			return occupied[i].Y < occupied[j].Y
+		}
+		return occupied[i].X < occupied[j].X
+	})
+
+	w.Header().Set("Content-Type", "text/x-matrix-market; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="map_%d_cells.mtx"`, mapID))
+	fmt.Fprintln(w, "%%MatrixMarket matrix coordinate integer general")
+	fmt.Fprintf(w, "%% map %d: rows = y, cols = x, value = dominant value index\n", mapID)
+	fmt.Fprintf(w, "%d %d %d\n", cfg.Height, cfg.Width, len(occupied))
+	for _, cell := range occupied {
+		fmt.Fprintf(w, "%d %d %d\n", cell.Y+1, cell.X+1, dominantValue(cell.Vals))
+	}
+}
+
+// GeoJSONFeature - круг карты в виде объекта GeoJSON
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// GeoJSONGeometry - точка (центр круга) или многоугольник (приближение круга)
+type GeoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+// defaultGeoJSONSegments - число вершин многоугольника, приближающего круг
+const defaultGeoJSONSegments = 32
+
+// circlePolygon приближает круг замкнутым многоугольником из segments вершин
+func circlePolygon(c Circle, segments int) [][][2]float64 {
+	ring := make([][2]float64, 0, segments+1)
+	for i := 0; i < segments; i++ {
+		angle := 2 * math.Pi * float64(i) / float64(segments)
+		ring = append(ring, [2]float64{
+			float64(c.X) + float64(c.Radius)*math.Cos(angle),
+			float64(c.Y) + float64(c.Radius)*math.Sin(angle),
+		})
+	}
+	ring = append(ring, ring[0])
+	return [][][2]float64{ring}
+}
+
+// geojsonHandler экспортирует круги карты как FeatureCollection в координатах сетки:
+// по умолчанию точками с радиусом в свойствах, при ?shape=polygon - многоугольниками
+func geojsonHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+
+	shape := r.URL.Query().Get("shape")
+	switch shape {
+	case "":
+		shape = "point"
+	case "point", "polygon":
+	default:
+		http.Error(w, "shape должен быть point или polygon", http.StatusBadRequest)
+		return
+	}
+	segments := defaultGeoJSONSegments
+	if v := r.URL.Query().Get("segments"); v != "" {
+		segments, err = strconv.Atoi(v)
+		if err != nil || segments < 3 || segments > 360 {
+			http.Error(w, "segments должен быть от 3 до 360", http.StatusBadRequest)
+			return
+		}
+	}
+
+	cfg, circles, err := loadMapGeometry(mapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	features := make([]GeoJSONFeature, 0, len(circles))
+	for i, c := range circles {
+		geometry := GeoJSONGeometry{Type: "Point", Coordinates: [2]int{c.X, c.Y}}
+		if shape == "polygon" {
+			geometry = GeoJSONGeometry{Type: "Polygon", Coordinates: circlePolygon(c, segments)}
+		}
+		props := map[string]interface{}{
+			"index":  i,
+			"type":   c.Type,
+			"radius": c.Radius,
+		}
+		if len(c.Meta) > 0 {
+			props["meta"] = c.Meta
+		}
+		features = append(features, GeoJSONFeature{Type: "Feature", Geometry: geometry, Properties: props})
+	}
+
+	resp := struct {
+		Type       string                 `json:"type"`
+		Features   []GeoJSONFeature       `json:"features"`
+		Properties map[string]interface{} `json:"properties"`
+	}{"FeatureCollection", features, map[string]interface{}{
+		"map_id": mapID,
+		"width":  cfg.Width,
+		"height": cfg.Height,
+	}}
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="map_%d.geojson"`, mapID))
+	json.NewEncoder(w).Encode(resp)
+}
+
+func legendHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cellTypeLegend)
+}
+
+// НОВЫЕ HANDLERS ДЛЯ ИГРОКОВ
+
+func spawnPlayerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req SpawnPlayerRequest
+	if err := decodeJSON(r, &req); err != nil {
+		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" {
+		req.Name = fmt.Sprintf("Игрок_%d", time.Now().Unix())
+	}
+
+	// Получаем карту и её круги
+	var circlesStr string
+	err := db.QueryRow("SELECT circles FROM maps WHERE id = ? AND deleted_at IS NULL", req.MapID).Scan(&circlesStr)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var circles []Circle
+	if err := json.Unmarshal([]byte(circlesStr), &circles); err != nil {
+		http.Error(w, "Ошибка парсинга circles: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Получаем точки спавна
+	spawns := getSpawnPoints(circles)
+	if len(spawns) == 0 {
+		http.Error(w, "На карте нет точек спавна", http.StatusBadRequest)
+		return
+	}
+
+	// Выбираем случайную позицию спавна
+	spawnX, spawnY := getRandomSpawnPoint(spawns)
+
+	// Создаем игрока в БД
+	res, err := db.Exec("INSERT INTO players (map_id, x, y, name) VALUES (?, ?, ?, ?)",
+		req.MapID, spawnX, spawnY, req.Name)
+	if err != nil {
+		http.Error(w, "Ошибка создания игрока: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	playerID, _ := res.LastInsertId()
+
+	player := Player{
+		ID:      int(playerID),
+		MapID:   req.MapID,
+		X:       spawnX,
+		Y:       spawnY,
+		Name:    req.Name,
+		Created: time.Now(),
+	}
+
+	mapLogf(req.MapID, "🎮 Игрок %s создан на карте %d в позиции (%d, %d)", req.Name, req.MapID, spawnX, spawnY)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(player)
+}
+
+func movePlayerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Извлекаем player_id из URL
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 4 {
+		http.Error(w, "Некорректный URL", http.StatusBadRequest)
+		return
+	}
+
+	playerID, err := strconv.Atoi(pathParts[3])
+	if err != nil {
+		http.Error(w, "Некорректный ID игрока", http.StatusBadRequest)
+		return
+	}
+
+	var req MovePlayerRequest
+	if err := decodeJSON(r, &req); err != nil {
+		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Получаем текущую позицию игрока и данные карты
+	var currentX, currentY, mapID int
+	err = db.QueryRow("SELECT x, y, map_id FROM players WHERE id = ?", playerID).
+		Scan(&currentX, &currentY, &mapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Игрок не найден", http.StatusNotFound)
+		} else {
+			http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Получаем размеры карты
+	var configStr string
+	err = db.QueryRow("SELECT config FROM maps WHERE id = ? AND deleted_at IS NULL", mapID).Scan(&configStr)
+	if err != nil {
+		http.Error(w, "Ошибка получения карты: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var cfg Config
+	if err := json.Unmarshal([]byte(configStr), &cfg); err != nil {
+		http.Error(w, "Ошибка парсинга config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Вычисляем новую позицию
+	newX, newY := currentX, currentY
+	switch req.Direction {
+	case "up":
+		newY = currentY - 1
+	case "down":
+		newY = currentY + 1
+	case "left":
+		newX = currentX - 1
+	case "right":
+		newX = currentX + 1
+	default:
+		http.Error(w, "Некорректное направление. Используйте: up, down, left, right", http.StatusBadRequest)
+		return
+	}
+
+	// Проверяем границы карты
+	if newX < 0 || newX >= cfg.Width || newY < 0 || newY >= cfg.Height {
+		http.Error(w, "Выход за границы карты", http.StatusBadRequest)
+		return
+	}
+
+	// Обновляем позицию игрока в БД
+	_, err = db.Exec("UPDATE players SET x = ?, y = ? WHERE id = ?", newX, newY, playerID)
+	if err != nil {
+		http.Error(w, "Ошибка обновления позиции: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🎮 Игрок %d переместился с (%d, %d) на (%d, %d)", playerID, currentX, currentY, newX, newY)
+
+	resp := struct {
+		PlayerID int    `json:"player_id"`
+		X        int    `json:"x"`
+		Y        int    `json:"y"`
+		Message  string `json:"message"`
+	}{playerID, newX, newY, fmt.Sprintf("Игрок перемещен %s на (%d, %d)", req.Direction, newX, newY)}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func playerViewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Извлекаем player_id из URL
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 4 {
+		http.Error(w, "Некорректный URL", http.StatusBadRequest)
+		return
+	}
+
+	playerID, err := strconv.Atoi(pathParts[3])
+	if err != nil {
+		http.Error(w, "Некорректный ID игрока", http.StatusBadRequest)
+		return
+	}
+	layer := 0
+	if v := r.URL.Query().Get("layer"); v != "" {
+		layer, err = strconv.Atoi(v)
+		if err != nil || layer < 0 {
+			http.Error(w, "Некорректный параметр layer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Получаем данные игрока
+	var playerX, playerY, mapID int
+	var playerName string
+	err = db.QueryRow("SELECT x, y, map_id, name FROM players WHERE id = ?", playerID).
+		Scan(&playerX, &playerY, &mapID, &playerName)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Игрок не найден", http.StatusNotFound)
+		} else {
+			http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Получаем данные карты
+	var configStr, circlesStr string
+	err = db.QueryRow("SELECT config, circles FROM maps WHERE id = ? AND deleted_at IS NULL", mapID).
+		Scan(&configStr, &circlesStr)
+	if err != nil {
+		http.Error(w, "Ошибка получения карты: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var cfg Config
+	var circles []Circle
+	if err := json.Unmarshal([]byte(configStr), &cfg); err != nil {
+		http.Error(w, "Ошибка парсинга config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal([]byte(circlesStr), &circles); err != nil {
+		http.Error(w, "Ошибка парсинга circles: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Получаем текущие клетки
+	cells, err := loadCellsFromDB(mapID)
+	if err != nil {
+		http.Error(w, "Ошибка загрузки клеток: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Создаем карту клеток для быстрого поиска; слои делят координаты, поэтому
+	// берем только выбранный
+	_, byLayer := splitLayers(cells)
+	cellMap := make(map[string][]int)
+	for _, cell := range byLayer[layer] {
+		key := fmt.Sprintf("%d,%d", cell.X, cell.Y)
+		cellMap[key] = cell.Vals
+	}
+
+	// Генерируем изображение обзора 5x5
+	img := image.NewRGBA(image.Rect(0, 0, 250, 250)) // 50px на клетку
+
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			mapX := playerX + dx
+			mapY := playerY + dy
+
+			imgX := (dx + 2) * 50
+			imgY := (dy + 2) * 50
+
+			// Определяем цвет клетки
+			var cellColor color.RGBA
+			if mapX < 0 || mapX >= cfg.Width || mapY < 0 || mapY >= cfg.Height {
+				// Вне карты - черный
+				cellColor = color.RGBA{0, 0, 0, 255}
+			} else {
+				cellType := getCellType(mapX, mapY, circles, cfg)
+				switch cellType {
+				case 0: // белая
+					cellColor = color.RGBA{255, 255, 255, 255}
+				case 1: // синяя
+					cellColor = color.RGBA{100, 150, 255, 255}
+				case 2: // зеленая (центр круга)
+					cellColor = color.RGBA{100, 255, 100, 255}
+				case 3: // стена (рамка карты)
+					cellColor = color.RGBA{90, 90, 90, 255}
+				}
+			}
+
+			// Заливаем клетку цветом
+			for y := imgY; y < imgY+50; y++ {
+				for x := imgX; x < imgX+50; x++ {
+					img.Set(x, y, cellColor)
+				}
+			}
+
+			// Добавляем границы клетки
+			borderColor := color.RGBA{0, 0, 0, 255}
+			for x := imgX; x < imgX+50; x++ {
+				img.Set(x, imgY, borderColor)
+				img.Set(x, imgY+49, borderColor)
+			}
+			for y := imgY; y < imgY+50; y++ {
+				img.Set(imgX, y, borderColor)
+				img.Set(imgX+49, y, borderColor)
+			}
+
+			// Отмечаем позицию игрока
+			if dx == 0 && dy == 0 {
+				// Рисуем красный круг в центре клетки игрока
+				centerX := imgX + 25
+				centerY := imgY + 25
+				for y := centerY - 8; y <= centerY+8; y++ {
+					for x := centerX - 8; x <= centerX+8; x++ {
+						if (x-centerX)*(x-centerX)+(y-centerY)*(y-centerY) <= 64 {
+							img.Set(x, y, color.RGBA{255, 0, 0, 255})
+						}
+					}
+				}
+			}
+
+			// Показываем числа в клетке
+			if mapX >= 0 && mapX < cfg.Width && mapY >= 0 && mapY < cfg.Height {
+				key := fmt.Sprintf("%d,%d", mapX, mapY)
+				if numbers, exists := cellMap[key]; exists && len(numbers) > 0 {
+					// Простой способ показать числа (первые два) цветом значения
+					if len(numbers) >= 1 {
+						drawNumber(img, imgX+5, imgY+5, numbers[0], paletteColor(numbers[0]))
+					}
+					if len(numbers) >= 2 {
+						drawNumber(img, imgX+5, imgY+25, numbers[1], paletteColor(numbers[1]))
+					}
+				}
+			}
+		}
+	}
+
+	// Отправляем изображение
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-cache")
+	png.Encode(w, img)
+
+	log.Printf("🎮 Создан обзор для игрока %d (%s) в позиции (%d, %d)", playerID, playerName, playerX, playerY)
+}
+
+// valueColors - базовые цвета первых значений на изображениях карты
+var valueColors = []color.RGBA{
+	{220, 50, 50, 255},
+	{50, 160, 50, 255},
+	{50, 80, 220, 255},
+	{230, 160, 0, 255},
+	{150, 50, 200, 255},
+	{0, 170, 170, 255},
+}
+
+// paletteColor возвращает цвет значения index. Первые значения берутся из valueColors,
+// дальше оттенок поворачивается на золотой угол, поэтому соседние индексы хорошо
+// различимы, а цвет не зависит от запуска.
+func paletteColor(index int) color.RGBA {
+	if index < 0 {
+		return color.RGBA{128, 128, 128, 255}
+	}
+	if index < len(valueColors) {
+		return valueColors[index]
+	}
+	hue := math.Mod(float64(index)*137.508, 360)
+	// Чередуем насыщенность и яркость, чтобы близкие оттенки отличались
+	sat, val := 0.75, 0.85
+	if index%2 == 1 {
+		sat, val = 0.9, 0.65
+	}
+	return hsvColor(hue, sat, val)
+}
+
+// hsvColor переводит цвет из HSV (hue в градусах, s и v от 0 до 1) в RGBA
+func hsvColor(hue, sat, val float64) color.RGBA {
+	c := val * sat
+	x := c * (1 - math.Abs(math.Mod(hue/60, 2)-1))
+	m := val - c
+	var r, g, b float64
+	switch {
+	case hue < 60:
+		r, g, b = c, x, 0
+	case hue < 120:
+		r, g, b = x, c, 0
+	case hue < 180:
+		r, g, b = 0, c, x
+	case hue < 240:
+		r, g, b = 0, x, c
+	case hue < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return color.RGBA{uint8(math.Round((r + m) * 255)), uint8(math.Round((g + m) * 255)), uint8(math.Round((b + m) * 255)), 255}
+}
+
+const (
+	defaultPaletteSize = 10
+	maxPaletteSize     = 256
+)
+
+// paletteHandler отдает цвета значений 0..n-1, совпадающие с серверными изображениями
+func paletteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	n := defaultPaletteSize
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxPaletteSize {
+			http.Error(w, fmt.Sprintf("n должен быть от 1 до %d", maxPaletteSize), http.StatusBadRequest)
+			return
+		}
 	}
 
-	if req.Name == "" {
-		req.Name = fmt.Sprintf("map_%d", time.Now().Unix())
+	type paletteEntry struct {
+		Index int    `json:"index"`
+		Hex   string `json:"hex"`
+		RGB   [3]int `json:"rgb"`
 	}
-
-	gen := NewMapGenerator(req.Config)
-	if err := gen.Generate(); err != nil {
-		http.Error(w, "Ошибка генерации: "+err.Error(), http.StatusBadRequest)
-		return
+	entries := make([]paletteEntry, n)
+	for i := range entries {
+		c := paletteColor(i)
+		entries[i] = paletteEntry{i, fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B), [3]int{int(c.R), int(c.G), int(c.B)}}
 	}
 
-	circles := gen.getAllCircles()
-	configBytes, _ := json.Marshal(req.Config)
-	circlesBytes, _ := json.Marshal(circles)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
 
-	res, err := db.Exec("INSERT INTO maps (name, config, circles) VALUES (?, ?, ?)", 
-		req.Name, string(configBytes), string(circlesBytes))
-	if err != nil {
-		http.Error(w, "Ошибка сохранения в БД: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+// renderMapImage рисует карту целиком: типы клеток и первое число в клетке.
+// Клетки должны принадлежать одному слою, иначе слои перекроют друг друга.
+func renderMapImage(cfg Config, circles []Circle, cells []Cell, scale int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, cfg.Width*scale, cfg.Height*scale))
 
-	id, _ := res.LastInsertId()
-	resp := Map{
-		ID:      int(id),
-		Name:    req.Name,
-		Config:  req.Config,
-		Circles: circles,
-		Epoch:   0,
-		Created: time.Now(),
+	cellMap := make(map[string][]int)
+	for _, cell := range cells {
+		cellMap[fmt.Sprintf("%d,%d", cell.X, cell.Y)] = cell.Vals
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	for my := 0; my < cfg.Height; my++ {
+		for mx := 0; mx < cfg.Width; mx++ {
+			var cellColor color.RGBA
+			switch getCellType(mx, my, circles, cfg) {
+			case 0: // белая
+				cellColor = color.RGBA{255, 255, 255, 255}
+			case 1: // синяя
+				cellColor = color.RGBA{100, 150, 255, 255}
+			case 2: // зеленая (центр круга)
+				cellColor = color.RGBA{100, 255, 100, 255}
+			case 3: // стена (рамка карты)
+				cellColor = color.RGBA{90, 90, 90, 255}
+			}
+			for y := my * scale; y < (my+1)*scale; y++ {
+				for x := mx * scale; x < (mx+1)*scale; x++ {
+					img.Set(x, y, cellColor)
+				}
+			}
+
+			// Число показываем квадратом цвета значения в центре клетки
+			if vals := cellMap[fmt.Sprintf("%d,%d", mx, my)]; len(vals) > 0 {
+				valColor := paletteColor(vals[0])
+				pad := scale / 4
+				for y := my*scale + pad; y < (my+1)*scale-pad; y++ {
+					for x := mx*scale + pad; x < (mx+1)*scale-pad; x++ {
+						img.Set(x, y, valColor)
+					}
+				}
+			}
+		}
+	}
+	return img
 }
 
-func distributeHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+const (
+	gifCellScale = 8
+	maxGIFFrames = 500
+)
+
+// animationHandler собирает GIF-анимацию карты из сохраненных снимков эпох
+// (нужен config.history); кадров не больше maxGIFFrames
+func animationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
 		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var req struct {
-		MapID         int       `json:"map_id"`
-		Probabilities []float64 `json:"probabilities"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
 		return
 	}
 
-	var configStr, circlesStr string
-	err := db.QueryRow("SELECT config, circles FROM maps WHERE id = ?", req.MapID).
-		Scan(&configStr, &circlesStr)
+	cfg, circles, err := loadMapGeometry(mapID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			http.Error(w, "Карта не найдена", http.StatusNotFound)
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
 		} else {
-			http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
 		}
 		return
 	}
+	if !cfg.History {
+		http.Error(w, "История эпох не включена для карты (config.history)", http.StatusBadRequest)
+		return
+	}
 
-	var cfg Config
-	var circles []Circle
-	if err := json.Unmarshal([]byte(configStr), &cfg); err != nil {
-		http.Error(w, "Ошибка парсинга config: "+err.Error(), http.StatusInternalServerError)
+	// Параметры: from/to - диапазон эпох, delay - задержка кадра в сотых секунды,
+	// layer - слой популяции
+	query := r.URL.Query()
+	from, to, delay, layer := 0, math.MaxInt32, 20, 0
+	for name, dst := range map[string]*int{"from": &from, "to": &to, "delay": &delay, "layer": &layer} {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "Некорректный параметр "+name, http.StatusBadRequest)
+				return
+			}
+			*dst = n
+		}
+	}
+
+	frames, err := loadHistory(mapID, from, to)
+	if err != nil {
+		http.Error(w, "Ошибка загрузки истории: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if err := json.Unmarshal([]byte(circlesStr), &circles); err != nil {
-		http.Error(w, "Ошибка парсинга circles: "+err.Error(), http.StatusInternalServerError)
+	if len(frames) == 0 {
+		http.Error(w, "Нет сохраненных эпох в указанном диапазоне", http.StatusNotFound)
 		return
 	}
+	if len(frames) > maxGIFFrames {
+		frames = frames[:maxGIFFrames]
+	}
 
-	cells := generateDistribution(cfg, circles, req.Probabilities)
+	anim := &gif.GIF{}
+	for _, frame := range frames {
+		_, byLayer := splitLayers(frame.Cells)
+		img := renderMapImage(cfg, circles, byLayer[layer], gifCellScale)
+		paletted := image.NewPaletted(img.Bounds(), palette.Plan9)
+		draw.Draw(paletted, img.Bounds(), img, image.Point{}, draw.Src)
+		anim.Image = append(anim.Image, paletted)
+		anim.Delay = append(anim.Delay, delay)
+	}
 
-	// Сохраняем клетки в БД
-	if err := saveCellsToDB(req.MapID, cells); err != nil {
-		http.Error(w, "Ошибка сохранения клеток: "+err.Error(), http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "image/gif")
+	if err := gif.EncodeAll(w, anim); err != nil {
+		log.Printf("❌ Ошибка кодирования GIF: %v", err)
 		return
 	}
-
-	resp := struct {
-		MapID int    `json:"map_id"`
-		Cells []Cell `json:"cells"`
-	}{req.MapID, cells}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	mapLogf(mapID, "🎞️  Анимация карты %d: %d кадров", mapID, len(frames))
 }
 
-func setSpeedsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+const (
+	defaultRecentEpochs = 10
+	maxRecentEpochs     = 200
+)
+
+// recentEpochsHandler возвращает клетки последних count эпох из истории
+func recentEpochsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
 		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var req SetSpeedsRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
 		return
 	}
 
-	if err := validateSpeeds(req.Speeds); err != nil {
-		http.Error(w, "Некорректные скорости: "+err.Error(), http.StatusBadRequest)
-		return
+	count := defaultRecentEpochs
+	if v := r.URL.Query().Get("count"); v != "" {
+		count, err = strconv.Atoi(v)
+		if err != nil || count <= 0 || count > maxRecentEpochs {
+			http.Error(w, fmt.Sprintf("count должен быть от 1 до %d", maxRecentEpochs), http.StatusBadRequest)
+			return
+		}
 	}
 
-	var exists int
-	err := db.QueryRow("SELECT COUNT(*) FROM maps WHERE id = ?", req.MapID).Scan(&exists)
-	if err != nil || exists == 0 {
-		http.Error(w, "Карта не найдена", http.StatusNotFound)
+	cfg, _, err := loadMapGeometry(mapID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
+		} else {
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if !cfg.History {
+		http.Error(w, "История эпох не включена для карты (config.history)", http.StatusBadRequest)
 		return
 	}
 
-	speedBytes, _ := json.Marshal(req.Speeds)
-	_, err = db.Exec("UPDATE maps SET speeds = ? WHERE id = ?", string(speedBytes), req.MapID)
+	frames, err := loadRecentHistory(mapID, count)
 	if err != nil {
-		log.Printf("❌ Ошибка SQL при сохранении скоростей: %v", err)
-		http.Error(w, "Ошибка сохранения скоростей: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Ошибка загрузки истории: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("✅ Скорости сохранены для карты %d", req.MapID)
-
 	resp := struct {
-		MapID   int       `json:"map_id"`
-		Speeds  []float64 `json:"speeds"`
-		Success bool      `json:"success"`
-	}{req.MapID, req.Speeds, true}
+		MapID  int            `json:"map_id"`
+		Epochs []HistoryFrame `json:"epochs"`
+	}{mapID, frames}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
-func newEpochHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+// historyHandler возвращает сохраненные снимки эпох постранично (?limit=&offset=)
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
 		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var req NewEpochRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
+		return
+	}
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, "Некорректная пагинация: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Получаем данные карты с обработкой NULL значений
-	var cfgStr, circlesStr, speedsStr sql.NullString
-	var epoch sql.NullInt64
-	err := db.QueryRow("SELECT config, circles, speeds, epoch FROM maps WHERE id = ?", 
-		req.MapID).Scan(&cfgStr, &circlesStr, &speedsStr, &epoch)
+	cfg, _, err := loadMapGeometry(mapID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			http.Error(w, "Карта не найдена", http.StatusNotFound)
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
 		} else {
-			log.Printf("❌ Ошибка SQL: %v", err)
-			http.Error(w, "Ошибка БД при получении карты: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
 		}
 		return
 	}
-
-	var cfg Config
-	var circles []Circle
-	var speeds []float64
-
-	if err := json.Unmarshal([]byte(cfgStr.String), &cfg); err != nil {
-		http.Error(w, "Ошибка парсинга config: "+err.Error(), http.StatusInternalServerError)
+	if !cfg.History {
+		http.Error(w, "История эпох не включена для карты (config.history)", http.StatusBadRequest)
 		return
 	}
-	if err := json.Unmarshal([]byte(circlesStr.String), &circles); err != nil {
-		http.Error(w, "Ошибка парсинга circles: "+err.Error(), http.StatusInternalServerError)
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM map_history WHERE map_id = ?", mapID).Scan(&total); err != nil {
+		http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if speedsStr.Valid && speedsStr.String != "" && speedsStr.String != "[]" {
-		if err := json.Unmarshal([]byte(speedsStr.String), &speeds); err != nil {
-			http.Error(w, "Ошибка парсинга speeds: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
+	rows, err := db.Query("SELECT epoch, cells FROM map_history WHERE map_id = ? ORDER BY epoch LIMIT ? OFFSET ?",
+		mapID, limit, offset)
+	if err != nil {
+		http.Error(w, "Ошибка загрузки истории: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
-
-	// Получаем текущие клетки из БД
-	cells, err := loadCellsFromDB(req.MapID)
+	frames, err := scanHistory(rows)
 	if err != nil {
-		log.Printf("⚠️  Ошибка загрузки клеток: %v", err)
-		http.Error(w, "Ошибка загрузки клеток: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Ошибка загрузки истории: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Если клеток нет, генерируем начальное распределение
-	if len(cells) == 0 {
-		cells = generateDistribution(cfg, circles, []float64{90.0, 10.0})
-		log.Printf("📋 Сгенерировано начальное распределение для карты %d", req.MapID)
-	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Page{total, limit, offset, frames})
+}
 
-	// Применяем движение, если есть скорости
-	if len(speeds) > 0 {
-		cells = moveNumbers(cfg, circles, cells, speeds)
-		log.Printf("🎯 Применено движение чисел для карты %d", req.MapID)
-	} else {
-		log.Printf("⚠️  Скорости не установлены для карты %d, числа не двигаются", req.MapID)
-	}
+const (
+	defaultHeatmapScale = 8
+	maxHeatmapScale     = 32
+)
 
-	// Увеличиваем эпоху
-	currentEpoch := int(epoch.Int64)
-	currentEpoch++
-	_, err = db.Exec("UPDATE maps SET epoch = ? WHERE id = ?", currentEpoch, req.MapID)
-	if err != nil {
-		log.Printf("❌ Ошибка обновления эпохи: %v", err)
-		http.Error(w, "Ошибка обновления эпохи: "+err.Error(), http.StatusInternalServerError)
-		return
+// computeHeatmap считает для каждой клетки долю эпох, в которых она была занята.
+// Результат - матрица [y][x] значений от 0 до 1.
+func computeHeatmap(cfg Config, frames []HistoryFrame) [][]float64 {
+	grid := make([][]float64, cfg.Height)
+	for y := range grid {
+		grid[y] = make([]float64, cfg.Width)
 	}
-
-	// Сохраняем новое состояние клеток
-	if err := saveCellsToDB(req.MapID, cells); err != nil {
-		log.Printf("❌ Ошибка сохранения клеток: %v", err)
-		http.Error(w, "Ошибка сохранения клеток: "+err.Error(), http.StatusInternalServerError)
-		return
+	if len(frames) == 0 {
+		return grid
 	}
+	for _, frame := range frames {
+		for _, cell := range frame.Cells {
+			if len(cell.Vals) == 0 || cell.X < 0 || cell.Y < 0 || cell.X >= cfg.Width || cell.Y >= cfg.Height {
+				continue
+			}
+			grid[cell.Y][cell.X]++
+		}
+	}
+	for y := range grid {
+		for x := range grid[y] {
+			grid[y][x] /= float64(len(frames))
+		}
+	}
+	return grid
+}
 
-	resp := struct {
-		MapID int    `json:"map_id"`
-		Epoch int    `json:"epoch"`
-		Cells []Cell `json:"cells"`
-	}{req.MapID, currentEpoch, cells}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+// heatmapColor переводит значение 0..1 в цвет шкалы синий -> желтый -> красный
+func heatmapColor(v float64) color.RGBA {
+	v = math.Max(0, math.Min(1, v))
+	if v < 0.5 {
+		t := v * 2
+		return color.RGBA{uint8(255 * t), uint8(255 * t), uint8(255 * (1 - t)), 255}
+	}
+	t := (v - 0.5) * 2
+	return color.RGBA{255, uint8(255 * (1 - t)), 0, 255}
 }
 
-// НОВЫЕ HANDLERS ДЛЯ ИГРОКОВ
+// renderHeatmap рисует тепловую карту, каждая клетка - квадрат scale x scale
+func renderHeatmap(grid [][]float64, scale int) *image.RGBA {
+	height := len(grid)
+	width := 0
+	if height > 0 {
+		width = len(grid[0])
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width*scale, height*scale))
+	for my, row := range grid {
+		for mx, v := range row {
+			draw.Draw(img, image.Rect(mx*scale, my*scale, (mx+1)*scale, (my+1)*scale),
+				&image.Uniform{heatmapColor(v)}, image.Point{}, draw.Src)
+		}
+	}
+	return img
+}
 
-func spawnPlayerHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+// heatmapHandler возвращает тепловую карту занятости клеток по истории эпох.
+// Параметр ?format=png отдает изображение (масштаб ?scale=), иначе JSON-матрицу.
+func heatmapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
 		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var req SpawnPlayerRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
 		return
 	}
 
-	if req.Name == "" {
-		req.Name = fmt.Sprintf("Игрок_%d", time.Now().Unix())
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "png" {
+		http.Error(w, "format должен быть json или png", http.StatusBadRequest)
+		return
+	}
+	scale := defaultHeatmapScale
+	if v := query.Get("scale"); v != "" {
+		scale, err = strconv.Atoi(v)
+		if err != nil || scale <= 0 || scale > maxHeatmapScale {
+			http.Error(w, fmt.Sprintf("scale должен быть от 1 до %d", maxHeatmapScale), http.StatusBadRequest)
+			return
+		}
 	}
 
-	// Получаем карту и её круги
-	var circlesStr string
-	err := db.QueryRow("SELECT circles FROM maps WHERE id = ?", req.MapID).Scan(&circlesStr)
+	cfg, _, err := loadMapGeometry(mapID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			http.Error(w, "Карта не найдена", http.StatusNotFound)
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
 		} else {
-			http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
 		}
 		return
 	}
-
-	var circles []Circle
-	if err := json.Unmarshal([]byte(circlesStr), &circles); err != nil {
-		http.Error(w, "Ошибка парсинга circles: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Получаем точки спавна
-	spawns := getSpawnPoints(circles)
-	if len(spawns) == 0 {
-		http.Error(w, "На карте нет точек спавна", http.StatusBadRequest)
+	if !cfg.History {
+		http.Error(w, "История эпох не включена для карты (config.history)", http.StatusBadRequest)
 		return
 	}
 
-	// Выбираем случайную позицию спавна
-	spawnX, spawnY := getRandomSpawnPoint(spawns)
-
-	// Создаем игрока в БД
-	res, err := db.Exec("INSERT INTO players (map_id, x, y, name) VALUES (?, ?, ?, ?)", 
-		req.MapID, spawnX, spawnY, req.Name)
+	frames, err := loadHistory(mapID, 0, math.MaxInt32)
 	if err != nil {
-		http.Error(w, "Ошибка создания игрока: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Ошибка загрузки истории: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	grid := computeHeatmap(cfg, frames)
 
-	playerID, _ := res.LastInsertId()
-
-	player := Player{
-		ID:      int(playerID),
-		MapID:   req.MapID,
-		X:       spawnX,
-		Y:       spawnY,
-		Name:    req.Name,
-		Created: time.Now(),
+	if format == "png" {
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, renderHeatmap(grid, scale))
+		return
 	}
 
-	log.Printf("🎮 Игрок %s создан на карте %d в позиции (%d, %d)", req.Name, req.MapID, spawnX, spawnY)
+	resp := struct {
+		MapID   int         `json:"map_id"`
+		Epochs  int         `json:"epochs"`
+		Heatmap [][]float64 `json:"heatmap"`
+	}{mapID, len(frames), grid}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(player)
+	json.NewEncoder(w).Encode(resp)
 }
 
-func movePlayerHandler(w http.ResponseWriter, r *http.Request) {
+// Annotation - текстовая пометка эпохи карты
+type Annotation struct {
+	ID      int       `json:"id"`
+	Epoch   int       `json:"epoch"`
+	Label   string    `json:"label"`
+	Created time.Time `json:"created_at"`
+}
+
+const maxAnnotationLength = 500
+
+// annotateHandler добавляет пометку к эпохе карты (по умолчанию - к текущей)
+func annotateHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Извлекаем player_id из URL
-	pathParts := strings.Split(r.URL.Path, "/")
-	if len(pathParts) < 4 {
-		http.Error(w, "Некорректный URL", http.StatusBadRequest)
-		return
-	}
-
-	playerID, err := strconv.Atoi(pathParts[3])
+	mapID, err := mapIDFromPath(r)
 	if err != nil {
-		http.Error(w, "Некорректный ID игрока", http.StatusBadRequest)
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
 		return
 	}
 
-	var req MovePlayerRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	var req struct {
+		Epoch *int   `json:"epoch"`
+		Label string `json:"label"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
 		http.Error(w, "Некорректный JSON: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	req.Label = strings.TrimSpace(req.Label)
+	if req.Label == "" {
+		http.Error(w, "label не может быть пустым", http.StatusBadRequest)
+		return
+	}
+	if len([]rune(req.Label)) > maxAnnotationLength {
+		http.Error(w, fmt.Sprintf("label длиннее %d символов", maxAnnotationLength), http.StatusBadRequest)
+		return
+	}
+	if req.Epoch != nil && *req.Epoch < 0 {
+		http.Error(w, "epoch не может быть отрицательным", http.StatusBadRequest)
+		return
+	}
 
-	// Получаем текущую позицию игрока и данные карты
-	var currentX, currentY, mapID int
-	err = db.QueryRow("SELECT x, y, map_id FROM players WHERE id = ?", playerID).
-		Scan(&currentX, &currentY, &mapID)
+	var epoch sql.NullInt64
+	err = db.QueryRow("SELECT epoch FROM maps WHERE id = ? AND deleted_at IS NULL", mapID).Scan(&epoch)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			http.Error(w, "Игрок не найден", http.StatusNotFound)
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
 		} else {
 			http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
 		}
 		return
 	}
 
-	// Получаем размеры карты
-	var configStr string
-	err = db.QueryRow("SELECT config FROM maps WHERE id = ?", mapID).Scan(&configStr)
+	annotation := Annotation{Epoch: int(epoch.Int64), Label: req.Label, Created: time.Now()}
+	if req.Epoch != nil {
+		annotation.Epoch = *req.Epoch
+	}
+	res, err := db.Exec("INSERT INTO map_annotations (map_id, epoch, label, created_at) VALUES (?, ?, ?, ?)",
+		mapID, annotation.Epoch, annotation.Label, annotation.Created)
 	if err != nil {
-		http.Error(w, "Ошибка получения карты: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Ошибка сохранения пометки: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	id, _ := res.LastInsertId()
+	annotation.ID = int(id)
+	mapLogf(mapID, "🏷️  Карта %d: пометка эпохи %d: %s", mapID, annotation.Epoch, annotation.Label)
 
-	var cfg Config
-	if err := json.Unmarshal([]byte(configStr), &cfg); err != nil {
-		http.Error(w, "Ошибка парсинга config: "+err.Error(), http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(annotation)
+}
+
+// annotationsHandler возвращает пометки эпох карты в порядке эпох
+func annotationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Вычисляем новую позицию
-	newX, newY := currentX, currentY
-	switch req.Direction {
-	case "up":
-		newY = currentY - 1
-	case "down":
-		newY = currentY + 1
-	case "left":
-		newX = currentX - 1
-	case "right":
-		newX = currentX + 1
-	default:
-		http.Error(w, "Некорректное направление. Используйте: up, down, left, right", http.StatusBadRequest)
+	mapID, err := mapIDFromPath(r)
+	if err != nil {
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
 		return
 	}
 
-	// Проверяем границы карты
-	if newX < 0 || newX >= cfg.Width || newY < 0 || newY >= cfg.Height {
-		http.Error(w, "Выход за границы карты", http.StatusBadRequest)
+	var exists int
+	err = db.QueryRow("SELECT COUNT(*) FROM maps WHERE id = ? AND deleted_at IS NULL", mapID).Scan(&exists)
+	if err != nil || exists == 0 {
+		writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
 		return
 	}
 
-	// Обновляем позицию игрока в БД
-	_, err = db.Exec("UPDATE players SET x = ?, y = ? WHERE id = ?", newX, newY, playerID)
+	rows, err := db.Query("SELECT id, epoch, label, created_at FROM map_annotations WHERE map_id = ? ORDER BY epoch, id", mapID)
 	if err != nil {
-		http.Error(w, "Ошибка обновления позиции: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer rows.Close()
 
-	log.Printf("🎮 Игрок %d переместился с (%d, %d) на (%d, %d)", playerID, currentX, currentY, newX, newY)
+	annotations := []Annotation{}
+	for rows.Next() {
+		var a Annotation
+		if err := rows.Scan(&a.ID, &a.Epoch, &a.Label, &a.Created); err != nil {
+			http.Error(w, "Ошибка чтения пометки: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		annotations = append(annotations, a)
+	}
 
 	resp := struct {
-		PlayerID int    `json:"player_id"`
-		X        int    `json:"x"`
-		Y        int    `json:"y"`
-		Message  string `json:"message"`
-	}{playerID, newX, newY, fmt.Sprintf("Игрок перемещен %s на (%d, %d)", req.Direction, newX, newY)}
+		MapID       int          `json:"map_id"`
+		Annotations []Annotation `json:"annotations"`
+	}{mapID, annotations}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
-func playerViewHandler(w http.ResponseWriter, r *http.Request) {
+// PopulationPoint - численность чисел на карте в одной эпохе
+type PopulationPoint struct {
+	Epoch  int         `json:"epoch"`
+	Total  int         `json:"total"`
+	Counts map[int]int `json:"counts"` // количество чисел по значению
+}
+
+// populationHandler возвращает временной ряд численности по сохраненной истории эпох
+func populationHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Извлекаем player_id из URL
-	pathParts := strings.Split(r.URL.Path, "/")
-	if len(pathParts) < 4 {
-		http.Error(w, "Некорректный URL", http.StatusBadRequest)
-		return
-	}
-
-	playerID, err := strconv.Atoi(pathParts[3])
+	mapID, err := mapIDFromPath(r)
 	if err != nil {
-		http.Error(w, "Некорректный ID игрока", http.StatusBadRequest)
+		http.Error(w, "Некорректный ID карты", http.StatusBadRequest)
 		return
 	}
 
-	// Получаем данные игрока
-	var playerX, playerY, mapID int
-	var playerName string
-	err = db.QueryRow("SELECT x, y, map_id, name FROM players WHERE id = ?", playerID).
-		Scan(&playerX, &playerY, &mapID, &playerName)
+	cfg, _, err := loadMapGeometry(mapID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			http.Error(w, "Игрок не найден", http.StatusNotFound)
+			writeJSONError(w, http.StatusNotFound, errCodeMapNotFound, "Карта не найдена")
 		} else {
-			http.Error(w, "Ошибка БД: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Ошибка загрузки карты: "+err.Error(), http.StatusInternalServerError)
 		}
 		return
 	}
-
-	// Получаем данные карты
-	var configStr, circlesStr string
-	err = db.QueryRow("SELECT config, circles FROM maps WHERE id = ?", mapID).
-		Scan(&configStr, &circlesStr)
-	if err != nil {
-		http.Error(w, "Ошибка получения карты: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	var cfg Config
-	var circles []Circle
-	if err := json.Unmarshal([]byte(configStr), &cfg); err != nil {
-		http.Error(w, "Ошибка парсинга config: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if err := json.Unmarshal([]byte(circlesStr), &circles); err != nil {
-		http.Error(w, "Ошибка парсинга circles: "+err.Error(), http.StatusInternalServerError)
+	if !cfg.History {
+		http.Error(w, "История эпох не включена для карты (config.history)", http.StatusBadRequest)
 		return
 	}
 
-	// Получаем текущие клетки
-	cells, err := loadCellsFromDB(mapID)
+	frames, err := loadHistory(mapID, 0, math.MaxInt32)
 	if err != nil {
-		http.Error(w, "Ошибка загрузки клеток: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Ошибка загрузки истории: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Создаем карту клеток для быстрого поиска
-	cellMap := make(map[string][]int)
-	for _, cell := range cells {
-		key := fmt.Sprintf("%d,%d", cell.X, cell.Y)
-		cellMap[key] = cell.Vals
-	}
-
-	// Генерируем изображение обзора 5x5
-	img := image.NewRGBA(image.Rect(0, 0, 250, 250)) // 50px на клетку
-
-	for dy := -2; dy <= 2; dy++ {
-		for dx := -2; dx <= 2; dx++ {
-			mapX := playerX + dx
-			mapY := playerY + dy
-
-			imgX := (dx + 2) * 50
-			imgY := (dy + 2) * 50
-
-			// Определяем цвет клетки
-			var cellColor color.RGBA
-			if mapX < 0 || mapX >= cfg.Width || mapY < 0 || mapY >= cfg.Height {
-				// Вне карты - черный
-				cellColor = color.RGBA{0, 0, 0, 255}
-			} else {
-				cellType := getCellType(mapX, mapY, circles)
-				switch cellType {
-				case 0: // белая
-					cellColor = color.RGBA{255, 255, 255, 255}
-				case 1: // синяя
-					cellColor = color.RGBA{100, 150, 255, 255}
-				case 2: // зеленая (центр круга)
-					cellColor = color.RGBA{100, 255, 100, 255}
-				}
-			}
-
-			// Заливаем клетку цветом
-			for y := imgY; y < imgY+50; y++ {
-				for x := imgX; x < imgX+50; x++ {
-					img.Set(x, y, cellColor)
-				}
-			}
-
-			// Добавляем границы клетки
-			borderColor := color.RGBA{0, 0, 0, 255}
-			for x := imgX; x < imgX+50; x++ {
-				img.Set(x, imgY, borderColor)
-				img.Set(x, imgY+49, borderColor)
-			}
-			for y := imgY; y < imgY+50; y++ {
-				img.Set(imgX, y, borderColor)
-				img.Set(imgX+49, y, borderColor)
-			}
-
-			// Отмечаем позицию игрока
-			if dx == 0 && dy == 0 {
-				// Рисуем красный круг в центре клетки игрока
-				centerX := imgX + 25
-				centerY := imgY + 25
-				for y := centerY - 8; y <= centerY + 8; y++ {
-					for x := centerX - 8; x <= centerX + 8; x++ {
-						if (x-centerX)*(x-centerX)+(y-centerY)*(y-centerY) <= 64 {
-							img.Set(x, y, color.RGBA{255, 0, 0, 255})
-						}
-					}
-				}
-			}
-
-			// Показываем числа в клетке
-			if mapX >= 0 && mapX < cfg.Width && mapY >= 0 && mapY < cfg.Height {
-				key := fmt.Sprintf("%d,%d", mapX, mapY)
-				if numbers, exists := cellMap[key]; exists && len(numbers) > 0 {
-					// Простой способ показать числа (первые два)
-					textColor := color.RGBA{0, 0, 0, 255}
-					if len(numbers) >= 1 {
-						drawNumber(img, imgX+5, imgY+5, numbers[0], textColor)
-					}
-					if len(numbers) >= 2 {
-						drawNumber(img, imgX+5, imgY+25, numbers[1], textColor)
-					}
-				}
+	points := make([]PopulationPoint, 0, len(frames))
+	for _, frame := range frames {
+		point := PopulationPoint{Epoch: frame.Epoch, Counts: map[int]int{}}
+		for _, cell := range frame.Cells {
+			for _, val := range cell.Vals {
+				point.Counts[val]++
+				point.Total++
 			}
 		}
+		points = append(points, point)
 	}
 
-	// Отправляем изображение
-	w.Header().Set("Content-Type", "image/png")
-	w.Header().Set("Cache-Control", "no-cache")
-	png.Encode(w, img)
+	resp := struct {
+		MapID      int               `json:"map_id"`
+		Population []PopulationPoint `json:"population"`
+	}{mapID, points}
 
-	log.Printf("🎮 Создан обзор для игрока %d (%s) в позиции (%d, %d)", playerID, playerName, playerX, playerY)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
 
 // Простая функция для рисования цифр
@@ -1210,13 +7296,158 @@ func drawDigit(img *image.RGBA, x, y, digit int, col color.RGBA) {
 	}
 }
 
+// tokenBucket - ведро токенов одного клиента
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter ограничивает частоту запросов алгоритмом token bucket:
+// глобально или отдельно для каждого IP
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // токенов в секунду
+	burst   float64
+	perIP   bool
+	buckets map[string]*tokenBucket
+}
+
+// maxRateBuckets - порог, после которого из памяти удаляются заполненные ведра
+const maxRateBuckets = 10000
+
+func newRateLimiter(rate float64, burst int, perIP bool) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		perIP:   perIP,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow забирает токен для ключа; при отказе возвращает время до появления токена
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if len(l.buckets) > maxRateBuckets {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// middleware возвращает 429 с заголовком Retry-After при превышении лимита
+func (l *rateLimiter) middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := "global"
+		if l.perIP {
+			key = r.RemoteAddr
+			if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				key = host
+			}
+		}
+		if ok, wait := l.allow(key); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Слишком много запросов", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// decodeJSON строго декодирует тело запроса: неизвестные поля считаются ошибкой
+func decodeJSON(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// requireJSON отклоняет запросы с телом не в формате JSON.
+// Отсутствующий заголовок Content-Type допускается.
+func requireJSON(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			mediaType, _, err := mime.ParseMediaType(ct)
+			if err != nil || mediaType != "application/json" {
+				http.Error(w, "Неподдерживаемый Content-Type: "+ct+", ожидается application/json",
+					http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// corsAllowedOrigins - разрешенные источники CORS из переменной окружения
+// CORS_ALLOWED_ORIGINS (через запятую). nil - разрешены все ("*").
+var corsAllowedOrigins map[string]bool
+
+// loadCORSOrigins читает список разрешенных источников из окружения
+func loadCORSOrigins() map[string]bool {
+	raw := strings.TrimSpace(os.Getenv("CORS_ALLOWED_ORIGINS"))
+	if raw == "" || raw == "*" {
+		return nil
+	}
+	origins := make(map[string]bool)
+	for _, origin := range strings.Split(raw, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins[origin] = true
+		}
+	}
+	return origins
+}
+
+// setCORSHeaders добавляет CORS заголовки. Возвращает false, если источник
+// запроса не входит в список разрешенных.
+func setCORSHeaders(w http.ResponseWriter, r *http.Request) bool {
+	if corsAllowedOrigins == nil {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if origin == "" || !corsAllowedOrigins[origin] {
+			return false
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key")
+	return true
+}
+
 func apiHandler(w http.ResponseWriter, r *http.Request) {
-	// Добавляем CORS заголовки
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	// Добавляем CORS заголовки; запросы без Origin (не из браузера) не ограничиваются
+	allowed := setCORSHeaders(w, r)
 
-	if r.Method == "OPTIONS" {
+	if r.Method == http.MethodOptions {
+		if !allowed {
+			http.Error(w, "Источник не разрешен", http.StatusForbidden)
+			return
+		}
+		// Preflight: кешируем результат в браузере на сутки
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
@@ -1225,28 +7456,243 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch {
 	case r.URL.Path == "/api/maps" && r.Method == http.MethodPost:
-		createMapHandler(w, r)
+		requireJSON(createMapHandler)(w, r)
+	case r.URL.Path == "/api/maps/generate-stream" && r.Method == http.MethodGet:
+		generateStreamHandler(w, r)
+	case r.URL.Path == "/api/maps/validate" && r.Method == http.MethodPost:
+		requireJSON(validateConfigHandler)(w, r)
+	case r.URL.Path == "/api/maps/import" && r.Method == http.MethodPost:
+		requireJSON(importMapHandler)(w, r)
 	case r.URL.Path == "/api/distribute" && r.Method == http.MethodPost:
-		distributeHandler(w, r)
+		requireJSON(distributeHandler)(w, r)
+	case r.URL.Path == "/api/distribute/batch" && r.Method == http.MethodPost:
+		requireJSON(distributeBatchHandler)(w, r)
 	case r.URL.Path == "/api/speeds" && r.Method == http.MethodPost:
-		setSpeedsHandler(w, r)
+		requireJSON(setSpeedsHandler)(w, r)
+	case r.URL.Path == "/api/presets" && r.Method == http.MethodGet:
+		presetsHandler(w, r)
+	case r.URL.Path == "/api/presets" && r.Method == http.MethodPost:
+		requireJSON(presetsHandler)(w, r)
 	case r.URL.Path == "/api/newEpoch" && r.Method == http.MethodPost:
-		newEpochHandler(w, r)
+		requireJSON(newEpochHandler)(w, r)
+	case r.URL.Path == "/api/tick" && r.Method == http.MethodPost:
+		tickHandler(w, r)
+	case r.URL.Path == "/api/palette" && r.Method == http.MethodGet:
+		paletteHandler(w, r)
+	case r.URL.Path == "/api/legend" && r.Method == http.MethodGet:
+		legendHandler(w, r)
+	case (r.URL.Path == "/api/maps" || r.URL.Path == "/api/maps/search") && r.Method == http.MethodGet:
+		searchMapsHandler(w, r)
+	case r.URL.Path == "/api/maps/compare" && r.Method == http.MethodGet:
+		compareMapsHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/territories") && r.Method == http.MethodGet:
+		territoriesHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/fingerprint") && r.Method == http.MethodGet:
+		fingerprintHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/trapped") && r.Method == http.MethodGet:
+		trappedHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/bounds") && r.Method == http.MethodGet:
+		boundsHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/animation.gif") && r.Method == http.MethodGet:
+		animationHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/recent") && r.Method == http.MethodGet:
+		recentEpochsHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/logs") && r.Method == http.MethodGet:
+		mapLogsHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/history") && r.Method == http.MethodGet:
+		historyHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/heatmap") && r.Method == http.MethodGet:
+		heatmapHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/annotate") && r.Method == http.MethodPost:
+		requireJSON(annotateHandler)(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/annotations") && r.Method == http.MethodGet:
+		annotationsHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/population") && r.Method == http.MethodGet:
+		populationHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/run") && r.Method == http.MethodPost:
+		requireJSON(runEpochsHandler)(w, r)
+	case debugMode && strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/converge") && r.Method == http.MethodPost:
+		requireJSON(convergeHandler)(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/jobs/") && r.Method == http.MethodGet:
+		jobStatusHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/jobs/") && r.Method == http.MethodDelete:
+		cancelJobHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/undo") && r.Method == http.MethodPost:
+		undoEpochHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/ascii") && r.Method == http.MethodGet:
+		asciiHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/grid") && r.Method == http.MethodGet:
+		gridHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/distribute-from-image") && r.Method == http.MethodPost:
+		distributeFromImageHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/circle-at") && r.Method == http.MethodGet:
+		circleAtHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/cells.mtx") && r.Method == http.MethodGet:
+		matrixMarketHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/geojson") && r.Method == http.MethodGet:
+		geojsonHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/restore") && r.Method == http.MethodPost:
+		restoreMapHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.Count(r.URL.Path, "/") == 3 && r.Method == http.MethodDelete:
+		deleteMapHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/regenerate") && r.Method == http.MethodPost:
+		requireJSON(regenerateHandler)(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/set-cells") && r.Method == http.MethodPost:
+		requireJSON(setCellsHandler)(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/recompute") && r.Method == http.MethodPost:
+		recomputeHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/speeds") && r.Method == http.MethodGet:
+		getSpeedsHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/cells") && r.Method == http.MethodGet:
+		cellsHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/circles") && r.Method == http.MethodGet:
+		getCirclesHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.HasSuffix(r.URL.Path, "/circles") && r.Method == http.MethodPost:
+		requireJSON(addCircleHandler)(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/maps/") && strings.Contains(r.URL.Path, "/circles/") && r.Method == http.MethodDelete:
+		deleteCircleHandler(w, r)
 
 	// НОВЫЕ ЭНДПОИНТЫ ДЛЯ ИГРОКОВ
 	case r.URL.Path == "/api/player/spawn" && r.Method == http.MethodPost:
-		spawnPlayerHandler(w, r)
+		requireJSON(spawnPlayerHandler)(w, r)
 	case strings.HasPrefix(r.URL.Path, "/api/player/") && strings.HasSuffix(r.URL.Path, "/move") && r.Method == http.MethodPost:
-		movePlayerHandler(w, r)
+		requireJSON(movePlayerHandler)(w, r)
 	case strings.HasPrefix(r.URL.Path, "/api/player/") && strings.HasSuffix(r.URL.Path, "/view") && r.Method == http.MethodGet:
 		playerViewHandler(w, r)
 
 	default:
-		http.Error(w, "Endpoint не найден", http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, errCodeRouteNotFound, "Endpoint не найден")
+	}
+}
+
+// selfTestDSN - общая in-memory база самопроверки (одна на все соединения пула)
+const selfTestDSN = "file:selftest?mode=memory&cache=shared"
+
+// runSelfTest прогоняет генерацию, распределение и эпоху движения на маленькой
+// карте в памяти, проверяя сохранение и загрузку клеток через схему БД.
+func runSelfTest() error {
+	if err := openDB(selfTestDSN); err != nil {
+		return fmt.Errorf("открытие БД: %v", err)
+	}
+	defer db.Close()
+
+	cfg := Config{Width: 15, Height: 15, Spawns: 1, Bedrooms: 1, SpawnR: 2, BedroomR: 1, MaxGap: 3}
+	if err := validateConfig(cfg); err != nil {
+		return fmt.Errorf("конфигурация: %v", err)
+	}
+	gen := NewMapGenerator(cfg)
+	if err := gen.Generate(); err != nil {
+		return fmt.Errorf("генерация: %v", err)
+	}
+	circles := gen.getAllCircles()
+	if len(circles) != cfg.Spawns+cfg.Bedrooms {
+		return fmt.Errorf("генерация: размещено кругов %d из %d", len(circles), cfg.Spawns+cfg.Bedrooms)
+	}
+
+	configBytes, _ := json.Marshal(cfg)
+	circlesBytes, _ := json.Marshal(circles)
+	res, err := db.Exec("INSERT INTO maps (name, config, circles) VALUES (?, ?, ?)",
+		"selftest", string(configBytes), string(circlesBytes))
+	if err != nil {
+		return fmt.Errorf("сохранение карты: %v", err)
+	}
+	id, _ := res.LastInsertId()
+	mapID := int(id)
+
+	countNumbers := func(cells []Cell) int {
+		n := 0
+		for _, cell := range cells {
+			n += len(cell.Vals)
+		}
+		return n
+	}
+
+	cells := generateDistribution(cfg, circles, []float64{50, 50}, defaultSelectorResolution, nil)
+	if len(cells) == 0 {
+		return fmt.Errorf("распределение: нет клеток")
+	}
+	// С одинаковым зерном распределение должно повторяться в точности
+	first, _ := json.Marshal(generateDistributionWithRNG(rand.New(rand.NewSource(42)), cfg, circles, []float64{50, 50}, defaultSelectorResolution, nil))
+	second, _ := json.Marshal(generateDistributionWithRNG(rand.New(rand.NewSource(42)), cfg, circles, []float64{50, 50}, defaultSelectorResolution, nil))
+	if !bytes.Equal(first, second) {
+		return fmt.Errorf("распределение: разный результат при одинаковом зерне")
+	}
+	if err := saveCellsToDB(mapID, cells); err != nil {
+		return fmt.Errorf("сохранение клеток: %v", err)
+	}
+	loaded, err := loadCellsFromDB(mapID)
+	if err != nil {
+		return fmt.Errorf("загрузка клеток: %v", err)
+	}
+	if countNumbers(loaded) != countNumbers(cells) {
+		return fmt.Errorf("загрузка клеток: чисел %d, ожидалось %d", countNumbers(loaded), countNumbers(cells))
+	}
+
+	moved, _ := moveNumbers(newRNG(), cfg, circles, loaded, []float64{50, 50}, MoveOptions{})
+	if countNumbers(moved) != countNumbers(loaded) {
+		return fmt.Errorf("движение: чисел %d, ожидалось %d", countNumbers(moved), countNumbers(loaded))
+	}
+	if _, _, _, err := saveCellsDiffToDB(mapID, moved); err != nil {
+		return fmt.Errorf("сохранение эпохи: %v", err)
+	}
+	reloaded, err := loadCellsFromDB(mapID)
+	if err != nil {
+		return fmt.Errorf("загрузка после эпохи: %v", err)
+	}
+	if countNumbers(reloaded) != countNumbers(moved) {
+		return fmt.Errorf("загрузка после эпохи: чисел %d, ожидалось %d", countNumbers(reloaded), countNumbers(moved))
+	}
+	return nil
+}
+
+// Параметры HTTP-сервера, рассчитанные на клиентов с частым опросом эпох:
+// соединения держатся открытыми между запросами, а медленные клиенты
+// не занимают их бесконечно. WriteTimeout не задан из-за SSE и долгих прогонов.
+const (
+	serverReadHeaderTimeout = 10 * time.Second
+	serverReadTimeout       = 30 * time.Second
+	serverIdleTimeout       = 120 * time.Second
+	serverMaxHeaderBytes    = 64 << 10
+)
+
+// newHTTPServer создает сервер с настроенными таймаутами keep-alive.
+// При запуске через ListenAndServeTLS net/http сам включает HTTP/2.
+func newHTTPServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		ReadTimeout:       serverReadTimeout,
+		IdleTimeout:       serverIdleTimeout,
+		MaxHeaderBytes:    serverMaxHeaderBytes,
+		TLSConfig:         &tls.Config{MinVersion: tls.VersionTLS12},
 	}
 }
 
 func main() {
+	rateLimit := flag.Float64("rate-limit", 0, "лимит запросов в секунду (0 - без ограничения)")
+	rateBurst := flag.Int("rate-burst", 10, "допустимый всплеск запросов")
+	ratePerIP := flag.Bool("rate-per-ip", true, "отдельный лимит для каждого IP")
+	flag.BoolVar(&compressCells, "compress-cells", false, "сжимать снимки истории эпох через gzip при сохранении")
+	flag.BoolVar(&debugMode, "debug", false, "включить отладочные эндпоинты")
+	cleanOrphans := flag.Bool("cleanup-orphans", false, "удалить при запуске клетки и историю несуществующих карт")
+	selfTest := flag.Bool("selftest", false, "перед запуском проверить генерацию и движение на карте в памяти")
+	tlsCert := flag.String("tls-cert", "", "путь к сертификату TLS (вместе с -tls-key включает HTTPS и HTTP/2)")
+	tlsKey := flag.String("tls-key", "", "путь к закрытому ключу TLS")
+	flag.Parse()
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("❌ Флаги -tls-cert и -tls-key задаются только вместе")
+	}
+
+	if *selfTest {
+		log.Println("🧪 Самопроверка...")
+		if err := runSelfTest(); err != nil {
+			log.Printf("❌ Самопроверка не пройдена: %v", err)
+			os.Exit(1)
+		}
+		log.Println("✅ Самопроверка пройдена")
+	}
+
 	log.Println("🚀 Запуск Circle-diagram сервера с поддержкой игроков...")
 	log.Println("📊 Инициализация базы данных...")
 	if err := initDB(); err != nil {
@@ -1254,19 +7700,96 @@ func main() {
 	}
 	defer db.Close()
 
-	http.HandleFunc("/api/", apiHandler)
+	if *cleanOrphans {
+		removed, err := cleanupOrphans()
+		if err != nil {
+			log.Printf("⚠️  Ошибка очистки осиротевших записей: %v", err)
+		}
+		for _, table := range orphanTables {
+			log.Printf("🧹 %s: удалено осиротевших строк: %d", table, removed[table])
+		}
+	}
+
+	handler := apiHandler
+	if *rateLimit > 0 {
+		handler = newRateLimiter(*rateLimit, *rateBurst, *ratePerIP).middleware(apiHandler)
+		log.Printf("🚦 Ограничение запросов: %.2f/с, всплеск %d, по IP: %v", *rateLimit, *rateBurst, *ratePerIP)
+	}
+	if compressCells {
+		log.Println("🗜️  Сжатие снимков истории включено")
+	}
+	corsAllowedOrigins = loadCORSOrigins()
+	if corsAllowedOrigins != nil {
+		log.Printf("🔒 CORS: разрешено источников: %d", len(corsAllowedOrigins))
+	}
+	http.HandleFunc("/api/", handler)
+	server := newHTTPServer(":8080")
 
-	log.Println("✅ Сервер запущен на порту :8080")
+	if *tlsCert != "" {
+		log.Println("✅ Сервер запущен на порту :8080 (HTTPS, HTTP/2)")
+	} else {
+		log.Println("✅ Сервер запущен на порту :8080")
+	}
 	log.Println("📋 Доступные endpoints:")
 	log.Println("   POST /api/maps - создание карты")
+	log.Println("   GET  /api/maps/generate-stream?config= - генерация с прогрессом (SSE)")
+	log.Println("   POST /api/maps/import - импорт карты с готовыми кругами")
+	log.Println("   POST /api/maps/validate - проверка конфигурации без генерации")
+	log.Println("   GET  /api/maps/compare?a=&b= - сравнение раскладок двух карт")
 	log.Println("   POST /api/distribute - распределение чисел")
+	log.Println("   POST /api/distribute/batch - распределение чисел для нескольких карт")
 	log.Println("   POST /api/speeds - установка скоростей")
+	log.Println("   GET/POST /api/presets - пресеты скоростей")
 	log.Println("   POST /api/newEpoch - переключение эпохи")
+	log.Println("   POST /api/tick - эпоха для всех карт со скоростями")
+	log.Println("   GET  /api/legend - расшифровка типов клеток")
+	log.Println("   GET  /api/palette?n= - цвета значений на изображениях")
+	log.Println("   GET  /api/maps?limit=&offset= - список карт")
+	log.Println("   GET  /api/maps/search?q= - поиск карт по имени")
+	log.Println("   GET  /api/maps/{id}/territories - территории кругов (Вороной)")
+	log.Println("   GET  /api/maps/{id}/fingerprint - хеш состояния карты")
+	log.Println("   GET  /api/maps/{id}/bounds - границы занятых клеток")
+	log.Println("   GET  /api/maps/{id}/trapped - занятые клетки, из которых числа не могут выйти")
+	log.Println("   GET  /api/maps/{id}/animation.gif - анимация по истории эпох")
+	log.Println("   GET  /api/maps/{id}/recent?count= - клетки последних эпох")
+	log.Println("   GET  /api/maps/{id}/history?limit=&offset= - снимки эпох постранично")
+	log.Println("   GET  /api/maps/{id}/logs - последние строки лога операций с картой")
+	log.Println("   GET  /api/maps/{id}/population - численность чисел по эпохам")
+	log.Println("   POST /api/maps/{id}/annotate - пометка эпохи")
+	log.Println("   GET  /api/maps/{id}/annotations - список пометок эпох")
+	log.Println("   GET  /api/maps/{id}/heatmap?format=&scale= - тепловая карта занятости клеток")
+	log.Println("   POST /api/maps/{id}/run - фоновый прогон эпох (или синхронный с return_intermediate)")
+	log.Println("   GET  /api/jobs/{id} - статус фоновой задачи")
+	log.Println("   DELETE /api/jobs/{id} - отмена фоновой задачи")
+	log.Println("   POST /api/maps/{id}/undo - откат последней эпохи")
+	log.Println("   GET  /api/maps/{id}/grid?empty=&strict= - клетки плотной матрицей")
+	log.Println("   GET  /api/maps/{id}/ascii?max_width=&layer= - карта текстом для терминала")
+	log.Println("   POST /api/maps/{id}/distribute-from-image?values=&layer= - распределение из PNG")
+	log.Println("   GET  /api/maps/{id}/circle-at?x=&y= - круг, содержащий клетку")
+	log.Println("   GET  /api/maps/{id}/cells.mtx - клетки в формате MatrixMarket")
+	log.Println("   GET  /api/maps/{id}/geojson?shape= - круги в формате GeoJSON")
+	log.Println("   GET  /api/maps/{id}/speeds?layer= - текущие скорости карты")
+	log.Println("   GET  /api/maps/{id}/cells?limit=&cursor= - клетки карты (постранично)")
+	log.Println("   GET  /api/maps/{id}/circles - конфигурация и круги без клеток")
+	log.Println("   POST /api/maps/{id}/circles - добавление круга")
+	log.Println("   DELETE /api/maps/{id}/circles/{index} - удаление круга")
+	log.Println("   POST /api/maps/{id}/recompute?relocate= - пересчет клеток по текущим кругам")
+	log.Println("   POST /api/maps/{id}/set-cells - явное задание клеток")
+	log.Println("   POST /api/maps/{id}/regenerate - новая раскладка кругов по той же конфигурации")
+	log.Println("   DELETE /api/maps/{id}?hard= - удаление карты (по умолчанию мягкое)")
+	log.Println("   POST /api/maps/{id}/restore - восстановление мягко удаленной карты")
+	if debugMode {
+		log.Println("🧪 Отладочные endpoints:")
+		log.Println("   POST /api/maps/{id}/converge - прогон эпох до стабилизации")
+	}
 	log.Println("🎮 НОВЫЕ ENDPOINTS ДЛЯ ИГРОКОВ:")
 	log.Println("   POST /api/player/spawn - создание игрока")
 	log.Println("   POST /api/player/{id}/move - перемещение игрока")
 	log.Println("   GET  /api/player/{id}/view - обзор игрока (картинка)")
 	log.Println("🎮 Готов к игре!")
 
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	if *tlsCert != "" {
+		log.Fatal(server.ListenAndServeTLS(*tlsCert, *tlsKey))
+	}
+	log.Fatal(server.ListenAndServe())
 }
@@ -0,0 +1,852 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testConfig - маленькая карта, которая быстро генерируется
+const testConfig = `{"width":20,"height":20,"spawn_count":1,"bedroom_count":1,"spawn_radius":2,"bedroom_radius":1,"max_gap":3}`
+
+// openTestDB открывает отдельную in-memory базу для теста
+func openTestDB(tb testing.TB) {
+	tb.Helper()
+	if err := openDB("file:" + tb.Name() + "?mode=memory&cache=shared"); err != nil {
+		tb.Fatalf("открытие БД: %v", err)
+	}
+	tb.Cleanup(func() { db.Close() })
+}
+
+// doRequest выполняет запрос к apiHandler
+func doRequest(method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	apiHandler(rec, req)
+	return rec
+}
+
+// createTestMap создает карту через API и возвращает ее ID
+func createTestMap(tb testing.TB, config string) int {
+	tb.Helper()
+	rec := doRequest(http.MethodPost, "/api/maps", `{"name":"test","config":`+config+`}`)
+	if rec.Code != http.StatusOK {
+		tb.Fatalf("создание карты: %d %s", rec.Code, rec.Body.String())
+	}
+	var m Map
+	if err := json.Unmarshal(rec.Body.Bytes(), &m); err != nil {
+		tb.Fatalf("ответ создания карты: %v", err)
+	}
+	return m.ID
+}
+
+func TestUnknownFieldsRejected(t *testing.T) {
+	openTestDB(t)
+	mapID := createTestMap(t, testConfig)
+	regenerate := fmt.Sprintf("/api/maps/%d/regenerate", mapID)
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{"create: поле верхнего уровня", "/api/maps", `{"name":"a","config":` + testConfig + `,"radius_spawn":2}`, http.StatusBadRequest},
+		{"create: поле внутри config", "/api/maps",
+			`{"name":"a","config":{"width":20,"height":20,"spawn_count":1,"bedroom_count":1,"radius_spawn":2,"bedroom_radius":1}}`,
+			http.StatusBadRequest},
+		{"regenerate: неизвестное поле", regenerate, `{"sed":1}`, http.StatusBadRequest},
+		{"regenerate: пустое тело", regenerate, ``, http.StatusOK},
+		{"regenerate: известное поле", regenerate, `{"seed":1}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(http.MethodPost, tt.path, tt.body)
+			if rec.Code != tt.want {
+				t.Fatalf("статус %d, ожидался %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+			if tt.want == http.StatusBadRequest && !strings.Contains(rec.Body.String(), "unknown field") {
+				t.Errorf("в ошибке нет имени поля: %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed string // CORS_ALLOWED_ORIGINS
+		origin  string
+		want    int
+	}{
+		{"все источники", "", "https://any.example", http.StatusNoContent},
+		{"разрешенный источник", "https://a.example, https://b.example", "https://b.example", http.StatusNoContent},
+		{"запрещенный источник", "https://a.example", "https://evil.example", http.StatusForbidden},
+		{"без Origin при списке", "https://a.example", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CORS_ALLOWED_ORIGINS", tt.allowed)
+			corsAllowedOrigins = loadCORSOrigins()
+			t.Cleanup(func() { corsAllowedOrigins = nil })
+
+			req := httptest.NewRequest(http.MethodOptions, "/api/maps", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			rec := httptest.NewRecorder()
+			apiHandler(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("статус %d, ожидался %d", rec.Code, tt.want)
+			}
+			if tt.want != http.StatusNoContent {
+				return
+			}
+			if got := rec.Header().Get("Access-Control-Max-Age"); got != "86400" {
+				t.Errorf("Access-Control-Max-Age = %q, ожидалось 86400", got)
+			}
+			if rec.Body.Len() != 0 {
+				t.Errorf("у ответа 204 есть тело: %q", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestOverlappingCirclesPriority(t *testing.T) {
+	cfg := Config{Width: 20, Height: 20}
+	spawn := Circle{X: 5, Y: 5, Radius: 3, Type: "spawn"}
+	bedroom := Circle{X: 7, Y: 5, Radius: 3, Type: "bedroom"}
+	smallSpawn := Circle{X: 7, Y: 6, Radius: 2, Type: "spawn"}
+
+	tests := []struct {
+		name     string
+		circles  []Circle
+		x, y     int
+		wantType int
+		want     Circle // круг, которому принадлежит клетка
+	}{
+		{"spawn важнее bedroom", []Circle{bedroom, spawn}, 6, 5, 1, spawn},
+		{"центр важнее типа", []Circle{spawn, bedroom}, 7, 5, 2, bedroom},
+		{"меньший радиус при одном типе", []Circle{spawn, smallSpawn}, 6, 6, 1, smallSpawn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Результат не должен зависеть от порядка кругов
+			reversed := []Circle{tt.circles[1], tt.circles[0]}
+			for _, circles := range [][]Circle{tt.circles, reversed} {
+				if got := getCellType(tt.x, tt.y, circles, cfg); got != tt.wantType {
+					t.Errorf("getCellType(%d,%d) = %d, ожидался %d", tt.x, tt.y, got, tt.wantType)
+				}
+				idx := owningCircle(tt.x, tt.y, circles, cfg)
+				if idx < 0 || circles[idx].X != tt.want.X || circles[idx].Y != tt.want.Y {
+					t.Errorf("owningCircle(%d,%d) = %d, ожидался круг %+v", tt.x, tt.y, idx, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNegativeMaxGapRejected(t *testing.T) {
+	openTestDB(t)
+
+	tests := []struct {
+		maxGap int
+		want   int
+	}{
+		{-1, http.StatusBadRequest},
+		{-100, http.StatusBadRequest},
+		{0, http.StatusOK},
+		{3, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.maxGap), func(t *testing.T) {
+			config := fmt.Sprintf(`{"width":20,"height":20,"spawn_count":1,"bedroom_count":1,"spawn_radius":2,"bedroom_radius":1,"max_gap":%d}`, tt.maxGap)
+			for _, path := range []string{"/api/maps", "/api/maps/import"} {
+				rec := doRequest(http.MethodPost, path, `{"name":"a","config":`+config+`}`)
+				if rec.Code != tt.want {
+					t.Fatalf("%s: статус %d, ожидался %d: %s", path, rec.Code, tt.want, rec.Body.String())
+				}
+				if tt.want == http.StatusBadRequest && !strings.Contains(rec.Body.String(), "max_gap") {
+					t.Errorf("%s: в ошибке не упомянут max_gap: %s", path, rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+// testGeometry генерирует круги маленькой карты без БД
+func testGeometry(tb testing.TB) (Config, []Circle) {
+	tb.Helper()
+	cfg := Config{Width: 20, Height: 20, Spawns: 1, Bedrooms: 1, SpawnR: 2, BedroomR: 1, MaxGap: 3}
+	gen := NewMapGenerator(cfg)
+	gen.rng = rand.New(rand.NewSource(1))
+	if err := gen.Generate(); err != nil {
+		tb.Fatalf("генерация: %v", err)
+	}
+	return cfg, gen.getAllCircles()
+}
+
+func TestSuccessiveRNGsUncorrelated(t *testing.T) {
+	cfg, circles := testGeometry(t)
+	cells := generateDistributionWithRNG(rand.New(rand.NewSource(1)), cfg, circles, []float64{50, 50}, defaultSelectorResolution, nil)
+
+	tests := []struct {
+		name string
+		run  func(rng *rand.Rand) interface{}
+	}{
+		{"последовательность", func(rng *rand.Rand) interface{} {
+			seq := make([]int64, 64)
+			for i := range seq {
+				seq[i] = rng.Int63()
+			}
+			return seq
+		}},
+		{"распределение", func(rng *rand.Rand) interface{} {
+			return generateDistributionWithRNG(rng, cfg, circles, []float64{50, 50}, defaultSelectorResolution, nil)
+		}},
+		{"движение", func(rng *rand.Rand) interface{} {
+			moved, _ := moveNumbers(rng, cfg, circles, cells, []float64{100, 100}, MoveOptions{})
+			return moved
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Генераторы создаются подряд, как в соседних запросах эпох
+			first, second := newRNG(), newRNG()
+			a, _ := json.Marshal(tt.run(first))
+			b, _ := json.Marshal(tt.run(second))
+			if bytes.Equal(a, b) {
+				t.Errorf("генераторы, созданные подряд, дали одинаковый результат")
+			}
+		})
+	}
+
+	// Пары значений двух генераторов не должны совпадать
+	first, second := newRNG(), newRNG()
+	same := 0
+	for i := 0; i < 1000; i++ {
+		if first.Intn(2) == second.Intn(2) {
+			same++
+		}
+	}
+	if same < 400 || same > 600 {
+		t.Errorf("совпало %d из 1000 бит, ожидалось около 500", same)
+	}
+}
+
+func TestZeroCircles(t *testing.T) {
+	openTestDB(t)
+	emptyID := createTestMap(t, `{"width":10,"height":8,"spawn_count":0,"bedroom_count":0,"spawn_radius":2,"bedroom_radius":1}`)
+	withCirclesID := createTestMap(t, testConfig)
+
+	cfg := Config{Width: 10, Height: 8}
+	for y := 0; y < cfg.Height; y++ {
+		for x := 0; x < cfg.Width; x++ {
+			if got := getCellType(x, y, nil, cfg); got != 0 {
+				t.Fatalf("getCellType(%d,%d) без кругов = %d, ожидалась белая клетка", x, y, got)
+			}
+		}
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		body        string
+		wantWarning string
+	}{
+		{"distribute без кругов", "/api/distribute", fmt.Sprintf(`{"map_id":%d,"probabilities":[100]}`, emptyID), noCirclesWarning},
+		{"newEpoch без кругов", "/api/newEpoch", fmt.Sprintf(`{"map_id":%d}`, emptyID), noCirclesWarning},
+		{"distribute с кругами", "/api/distribute", fmt.Sprintf(`{"map_id":%d,"probabilities":[100]}`, withCirclesID), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(http.MethodPost, tt.path, tt.body)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("статус %d: %s", rec.Code, rec.Body.String())
+			}
+			var resp struct {
+				Cells   []Cell `json:"cells"`
+				Warning string `json:"warning"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("ответ: %v", err)
+			}
+			if resp.Warning != tt.wantWarning {
+				t.Errorf("warning = %q, ожидалось %q", resp.Warning, tt.wantWarning)
+			}
+			if tt.wantWarning == "" {
+				return
+			}
+			// Все клетки белые, поэтому распределение покрывает всю карту
+			if len(resp.Cells) != cfg.Width*cfg.Height {
+				t.Errorf("клеток %d, ожидалось %d", len(resp.Cells), cfg.Width*cfg.Height)
+			}
+		})
+	}
+}
+
+func TestEmptyListsSerializeAsArrays(t *testing.T) {
+	openTestDB(t)
+	mapID := createTestMap(t, `{"width":10,"height":8,"spawn_count":0,"bedroom_count":0,"spawn_radius":2,"bedroom_radius":1}`)
+
+	tests := []struct {
+		name string
+		path string
+		key  string
+	}{
+		{"speeds", fmt.Sprintf("/api/maps/%d/speeds", mapID), "speeds"},
+		{"cells", fmt.Sprintf("/api/maps/%d/cells", mapID), "cells"},
+		{"circles", fmt.Sprintf("/api/maps/%d/circles", mapID), "circles"},
+		{"trapped", fmt.Sprintf("/api/maps/%d/trapped", mapID), "cells"},
+		{"annotations", fmt.Sprintf("/api/maps/%d/annotations", mapID), "annotations"},
+		{"search", "/api/maps/search?q=nothing", "items"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(http.MethodGet, tt.path, "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("статус %d: %s", rec.Code, rec.Body.String())
+			}
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(rec.Body.Bytes(), &fields); err != nil {
+				t.Fatalf("ответ %q: %v", rec.Body.String(), err)
+			}
+			if got := string(fields[tt.key]); got != "[]" {
+				t.Errorf("%s = %s, ожидалось []", tt.key, got)
+			}
+		})
+	}
+}
+
+func TestSortDirection(t *testing.T) {
+	// Сетка 3x3 без кругов: в центре число 1, слева нули, справа двойки,
+	// сверху и снизу от центра пустые клетки
+	cfg := Config{Width: 3, Height: 3}
+	var cells []Cell
+	for y := 0; y < 3; y++ {
+		cells = append(cells, Cell{X: 0, Y: y, Vals: []int{0}}, Cell{X: 2, Y: y, Vals: []int{2}})
+	}
+	cells = append(cells, Cell{X: 1, Y: 1, Vals: []int{1}})
+	start := make(map[[2]int][]int)
+	for _, cell := range cells {
+		start[[2]int{cell.X, cell.Y}] = cell.Vals
+	}
+	speeds := []float64{0, 100, 0} // двигается только число 1
+
+	tests := []struct {
+		direction string
+		allowed   map[int]bool // допустимые столбцы, куда может попасть число 1
+	}{
+		{sortLower, map[int]bool{0: true, 1: true}},
+		{sortHigher, map[int]bool{1: true, 2: true}},
+		{"", map[int]bool{0: true, 1: true, 2: true}},
+	}
+	for _, tt := range tests {
+		t.Run("direction="+tt.direction, func(t *testing.T) {
+			landed := make(map[int]int) // столбец -> сколько раз число 1 туда попало
+			for seed := int64(0); seed < 200; seed++ {
+				moved, _ := moveNumbers(rand.New(rand.NewSource(seed)), cfg, nil, cells, speeds, MoveOptions{SortDirection: tt.direction})
+				for _, cell := range moved {
+					for _, val := range cell.Vals {
+						if val != 1 {
+							continue
+						}
+						landed[cell.X]++
+						if occupants := start[[2]int{cell.X, cell.Y}]; cell.X != 1 && !sortAllowed(tt.direction, 1, occupants) {
+							t.Fatalf("seed %d: число 1 попало в клетку (%d,%d) со значениями %v", seed, cell.X, cell.Y, occupants)
+						}
+					}
+				}
+			}
+			for x := 0; x < 3; x++ {
+				if landed[x] > 0 && !tt.allowed[x] {
+					t.Errorf("число 1 попало в столбец %d %d раз", x, landed[x])
+				}
+				if landed[x] == 0 && tt.allowed[x] {
+					t.Errorf("число 1 ни разу не попало в столбец %d", x)
+				}
+			}
+		})
+	}
+}
+
+func TestDistributionDeterministicWithSeed(t *testing.T) {
+	cfg, circles := testGeometry(t)
+	probs := []float64{30, 50, 20}
+
+	tests := []struct {
+		name     string
+		generate func(rng *rand.Rand) []Cell
+	}{
+		{"generateDistributionWithRNG", func(rng *rand.Rand) []Cell {
+			return generateDistributionWithRNG(rng, cfg, circles, probs, defaultSelectorResolution, nil)
+		}},
+		{"с полосами плотности", func(rng *rand.Rand) []Cell {
+			bands := []DensityBand{{MaxDistance: 2, MinCount: 2, MaxCount: 2}, {MinCount: 0, MaxCount: 1}}
+			return generateDistributionWithRNG(rng, cfg, circles, probs, defaultSelectorResolution, bands)
+		}},
+		{"generateTypedDistributionWithRNG", func(rng *rand.Rand) []Cell {
+			return generateTypedDistributionWithRNG(rng, cfg, circles, probs, []float64{100}, []float64{10, 90}, defaultSelectorResolution, nil)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := tt.generate(rand.New(rand.NewSource(42)))
+			second := tt.generate(rand.New(rand.NewSource(42)))
+			if len(first) == 0 {
+				t.Fatal("пустое распределение")
+			}
+			if !reflect.DeepEqual(first, second) {
+				t.Errorf("одинаковое зерно дало разные распределения")
+			}
+			if other := tt.generate(rand.New(rand.NewSource(43))); reflect.DeepEqual(first, other) {
+				t.Errorf("разные зерна дали одинаковые распределения")
+			}
+		})
+	}
+}
+
+// benchmarkSaveCells сохраняет почти равновесную карту 100x100: между эпохами
+// меняется около 1% клеток
+func benchmarkSaveCells(b *testing.B, save func(mapID int, cells []Cell) error) {
+	openTestDB(b)
+	res, err := db.Exec("INSERT INTO maps (name, config, circles) VALUES (?, ?, ?)", "bench", `{"width":100,"height":100}`, "[]")
+	if err != nil {
+		b.Fatalf("создание карты: %v", err)
+	}
+	id, _ := res.LastInsertId()
+	mapID := int(id)
+
+	rng := rand.New(rand.NewSource(1))
+	even := make([]Cell, 0, 100*100)
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 100; x++ {
+			even = append(even, Cell{X: x, Y: y, Vals: []int{rng.Intn(2)}})
+		}
+	}
+	odd := make([]Cell, len(even))
+	copy(odd, even)
+	for i := 0; i < len(odd)/100; i++ {
+		j := rng.Intn(len(odd))
+		odd[j].Vals = []int{1 - odd[j].Vals[0]}
+	}
+	if err := saveCellsToDB(mapID, even); err != nil {
+		b.Fatalf("начальное сохранение: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cells := odd
+		if i%2 == 1 {
+			cells = even
+		}
+		if err := save(mapID, cells); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSaveCellsFull(b *testing.B) {
+	benchmarkSaveCells(b, saveCellsToDB)
+}
+
+func BenchmarkSaveCellsDiff(b *testing.B) {
+	benchmarkSaveCells(b, func(mapID int, cells []Cell) error {
+		_, _, _, err := saveCellsDiffToDB(mapID, cells)
+		return err
+	})
+}
+
+func TestTickWaitsForMapLock(t *testing.T) {
+	openTestDB(t)
+	mapID := createTestMap(t, testConfig)
+
+	// Пока карту держит другой изменяющий путь, эпоха не начинается
+	unlock := mapLocks.lock(mapID)
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := tickMap(mapID)
+		done <- err
+	}()
+	select {
+	case <-done:
+		unlock()
+		t.Fatal("tickMap выполнился, не дождавшись блокировки карты")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+
+	if err := <-done; err != nil {
+		t.Fatalf("tickMap: %v", err)
+	}
+	m, err := loadMap(mapID)
+	if err != nil {
+		t.Fatalf("загрузка карты: %v", err)
+	}
+	if m.Epoch != 1 {
+		t.Errorf("эпоха %d, ожидалась 1", m.Epoch)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	openTestDB(t)
+	mapID := createTestMap(t, testConfig)
+
+	job := jobs.create(mapID, 5)
+	path := fmt.Sprintf("/api/jobs/%d", job.ID)
+	if rec := doRequest(http.MethodDelete, path, ""); rec.Code != http.StatusAccepted {
+		t.Fatalf("отмена: статус %d: %s", rec.Code, rec.Body.String())
+	}
+	runEpochsJob(job.ID, mapID, 5)
+
+	got, _ := jobs.get(job.ID)
+	if got.Status != "cancelled" || got.Done != 0 || got.Finished == nil {
+		t.Errorf("задача после отмены: %+v", got)
+	}
+	if rec := doRequest(http.MethodDelete, path, ""); rec.Code != http.StatusConflict {
+		t.Errorf("повторная отмена: статус %d, ожидался 409", rec.Code)
+	}
+	if rec := doRequest(http.MethodDelete, "/api/jobs/999999", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("отмена несуществующей задачи: статус %d, ожидался 404", rec.Code)
+	}
+}
+
+func TestCompressedHistorySnapshot(t *testing.T) {
+	openTestDB(t)
+	mapID := createTestMap(t, testConfig)
+	cfg, circles := testGeometry(t)
+	cells := generateDistributionWithRNG(rand.New(rand.NewSource(1)), cfg, circles, []float64{50, 50}, defaultSelectorResolution, nil)
+
+	t.Cleanup(func() { compressCells = false })
+	for epoch, compress := range []bool{false, true} {
+		compressCells = compress
+		if err := saveHistorySnapshot(db, mapID, epoch, cells); err != nil {
+			t.Fatalf("сохранение снимка: %v", err)
+		}
+	}
+
+	sizes := make([]int, 2)
+	for epoch := range sizes {
+		if err := db.QueryRow("SELECT length(cells) FROM map_history WHERE map_id = ? AND epoch = ?", mapID, epoch).Scan(&sizes[epoch]); err != nil {
+			t.Fatalf("размер снимка: %v", err)
+		}
+	}
+	if sizes[1]*2 > sizes[0] {
+		t.Errorf("сжатый снимок %d байт, несжатый %d: ожидалось сжатие хотя бы вдвое", sizes[1], sizes[0])
+	}
+
+	frames, err := loadHistory(mapID, 0, 1)
+	if err != nil {
+		t.Fatalf("загрузка истории: %v", err)
+	}
+	if len(frames) != 2 || !reflect.DeepEqual(frames[0].Cells, frames[1].Cells) || !reflect.DeepEqual(frames[1].Cells, cells) {
+		t.Errorf("сжатый снимок прочитан не так, как сохранен")
+	}
+}
+
+func TestInteractionFactorLimitsMovement(t *testing.T) {
+	// Сетка 3x3 без кругов: в центре число 0, вокруг единицы, которые не двигаются.
+	// У каждого соседа есть свободное место, поэтому число 0 никогда не заблокировано.
+	cfg := Config{Width: 3, Height: 3}
+	var cells []Cell
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 3; x++ {
+			val := 1
+			if x == 1 && y == 1 {
+				val = 0
+			}
+			cells = append(cells, Cell{X: x, Y: y, Vals: []int{val}})
+		}
+	}
+	speeds := []float64{100, 0}
+
+	tests := []struct {
+		factor   float64
+		min, max float64 // допустимая доля эпох, в которых число 0 сдвинулось
+	}{
+		{0, 0, 0},
+		{0.5, 0.4, 0.6},
+		{1, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.factor), func(t *testing.T) {
+			opts := MoveOptions{ValueInteractions: [][]float64{{1, tt.factor}}}
+			const runs = 400
+			moved := 0
+			for seed := int64(0); seed < runs; seed++ {
+				_, stats := moveNumbers(rand.New(rand.NewSource(seed)), cfg, nil, cells, speeds, opts)
+				if stats.Blocked != 0 {
+					t.Fatalf("seed %d: отказ от шага посчитан как блокировка", seed)
+				}
+				moved += stats.Moved
+			}
+			if rate := float64(moved) / runs; rate < tt.min || rate > tt.max {
+				t.Errorf("число сдвинулось в %.2f эпох, ожидалось от %.2f до %.2f", rate, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestWalkBackToOriginCountsAsStayed(t *testing.T) {
+	// Полоса 2x1: из любой клетки есть только один сосед, поэтому путь из двух
+	// шагов всегда возвращается в исходную клетку
+	cfg := Config{Width: 2, Height: 1}
+	cells := []Cell{{X: 0, Y: 0, Vals: []int{0}}}
+	opts := MoveOptions{MaxSteps: 2}
+
+	for seed := int64(0); seed < 20; seed++ {
+		moved, stats := moveNumbers(rand.New(rand.NewSource(seed)), cfg, nil, cells, []float64{100}, opts)
+		if stats.Moved != 0 || stats.Stayed != 1 {
+			t.Fatalf("seed %d: moved=%d stayed=%d, ожидалось 0 и 1", seed, stats.Moved, stats.Stayed)
+		}
+		if len(moved) != 1 || moved[0].X != 0 {
+			t.Fatalf("seed %d: число оказалось в %+v", seed, moved)
+		}
+	}
+}
+
+func TestCorruptCellsBlockUpdates(t *testing.T) {
+	openTestDB(t)
+	mapID := createTestMap(t, testConfig)
+	if _, err := db.Exec("INSERT INTO map_cells (map_id, x, y, layer, cell_values, cell_ages) VALUES (?, 0, 0, 0, ?, '')", mapID, "not json"); err != nil {
+		t.Fatalf("вставка поврежденной клетки: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		body string
+	}{
+		{"newEpoch", "/api/newEpoch", fmt.Sprintf(`{"map_id":%d}`, mapID)},
+		{"distribute", "/api/distribute", fmt.Sprintf(`{"map_id":%d,"probabilities":[100]}`, mapID)},
+		{"recompute", fmt.Sprintf("/api/maps/%d/recompute", mapID), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(http.MethodPost, tt.path, tt.body)
+			if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "поврежденных клеток: 1") {
+				t.Errorf("статус %d: %s", rec.Code, rec.Body.String())
+			}
+			var stored string
+			if err := db.QueryRow("SELECT cell_values FROM map_cells WHERE map_id = ? AND x = 0 AND y = 0", mapID).Scan(&stored); err != nil || stored != "not json" {
+				t.Errorf("поврежденная клетка не сохранилась: %q, %v", stored, err)
+			}
+		})
+	}
+
+	// Чтение по-прежнему пропускает поврежденные строки
+	if rec := doRequest(http.MethodGet, fmt.Sprintf("/api/maps/%d/cells", mapID), ""); rec.Code != http.StatusOK {
+		t.Errorf("чтение клеток: статус %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestImportCircleValidation(t *testing.T) {
+	openTestDB(t)
+
+	tests := []struct {
+		name    string
+		circles string
+		want    int
+		reason  string // ожидаемая причина конфликта
+	}{
+		{"общий центр нулевых радиусов", `[{"x":5,"y":5,"radius":0,"type":"spawn"},{"x":5,"y":5,"radius":0,"type":"bedroom"}]`,
+			http.StatusBadRequest, "same_center"},
+		{"общий центр", `[{"x":5,"y":5,"radius":2,"type":"spawn"},{"x":5,"y":5,"radius":1,"type":"bedroom"}]`,
+			http.StatusBadRequest, "same_center"},
+		{"пересечение", `[{"x":5,"y":5,"radius":2,"type":"spawn"},{"x":7,"y":5,"radius":1,"type":"bedroom"}]`,
+			http.StatusBadRequest, "overlap"},
+		{"неизвестный тип", `[{"x":5,"y":5,"radius":2,"type":"room"}]`, http.StatusBadRequest, ""},
+		{"без типа", `[{"x":5,"y":5,"radius":2}]`, http.StatusBadRequest, ""},
+		{"корректные круги", `[{"x":5,"y":5,"radius":2,"type":"spawn"},{"x":12,"y":12,"radius":1,"type":"bedroom"}]`,
+			http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(http.MethodPost, "/api/maps/import", `{"name":"a","config":`+testConfig+`,"circles":`+tt.circles+`}`)
+			if rec.Code != tt.want {
+				t.Fatalf("статус %d, ожидался %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+			if tt.reason != "" && !strings.Contains(rec.Body.String(), `"reason":"`+tt.reason+`"`) {
+				t.Errorf("нет конфликта %s: %s", tt.reason, rec.Body.String())
+			}
+		})
+	}
+
+	// Круг, целиком занятый центром, отклоняется
+	config := `{"width":20,"height":20,"spawn_count":1,"bedroom_count":1,"spawn_radius":2,"bedroom_radius":2,"center_radius":1}`
+	circles := `[{"x":5,"y":5,"radius":1,"type":"spawn"}]`
+	if rec := doRequest(http.MethodPost, "/api/maps/import", `{"name":"a","config":`+config+`,"circles":`+circles+`}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("радиус не больше center_radius: статус %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPlayerViewShowsOneLayer(t *testing.T) {
+	openTestDB(t)
+	mapID := createTestMap(t, testConfig)
+	res, err := db.Exec("INSERT INTO players (map_id, x, y, name) VALUES (?, 1, 1, 'p')", mapID)
+	if err != nil {
+		t.Fatalf("создание игрока: %v", err)
+	}
+	playerID, _ := res.LastInsertId()
+	addCell := func(layer, val int) {
+		t.Helper()
+		if _, err := db.Exec("INSERT INTO map_cells (map_id, x, y, layer, cell_values, cell_ages) VALUES (?, 1, 1, ?, ?, '')",
+			mapID, layer, fmt.Sprintf("[%d]", val)); err != nil {
+			t.Fatalf("вставка клетки: %v", err)
+		}
+	}
+	view := func(query string) string {
+		t.Helper()
+		rec := doRequest(http.MethodGet, fmt.Sprintf("/api/player/%d/view%s", playerID, query), "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("обзор%s: статус %d: %s", query, rec.Code, rec.Body.String())
+		}
+		return rec.Body.String()
+	}
+
+	addCell(0, 1)
+	base := view("")
+	addCell(1, 7)
+	if view("") != base || view("?layer=0") != base {
+		t.Errorf("клетка слоя 1 попала в обзор слоя 0")
+	}
+	if view("?layer=1") == base {
+		t.Errorf("обзор слоя 1 не отличается от слоя 0")
+	}
+	if rec := doRequest(http.MethodGet, fmt.Sprintf("/api/player/%d/view?layer=-1", playerID), ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("layer=-1: статус %d", rec.Code)
+	}
+}
+
+func TestDistributeHistoryFailure(t *testing.T) {
+	openTestDB(t)
+	mapID := createTestMap(t, strings.Replace(testConfig, "{", `{"history":true,`, 1))
+	if _, err := db.Exec("DROP TABLE map_history"); err != nil {
+		t.Fatalf("удаление таблицы истории: %v", err)
+	}
+	body := fmt.Sprintf(`{"map_id":%d,"probabilities":[100]}`, mapID)
+	countCells := func() int {
+		t.Helper()
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM map_cells WHERE map_id = ?", mapID).Scan(&n); err != nil {
+			t.Fatalf("подсчет клеток: %v", err)
+		}
+		return n
+	}
+
+	// Одиночное распределение сохраняется, ошибка истории только в логе
+	if rec := doRequest(http.MethodPost, "/api/distribute", body); rec.Code != http.StatusOK {
+		t.Fatalf("distribute: статус %d: %s", rec.Code, rec.Body.String())
+	}
+	saved := countCells()
+	if saved == 0 {
+		t.Fatalf("клетки не сохранены")
+	}
+
+	// В пакете ошибка истории отменяет транзакцию карты
+	if _, err := db.Exec("DELETE FROM map_cells WHERE map_id = ?", mapID); err != nil {
+		t.Fatalf("очистка клеток: %v", err)
+	}
+	rec := doRequest(http.MethodPost, "/api/distribute/batch", "["+body+"]")
+	var resp struct {
+		Results []BatchDistributeResult `json:"results"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || len(resp.Results) != 1 {
+		t.Fatalf("ответ пакета: %v: %s", err, rec.Body.String())
+	}
+	if resp.Results[0].OK || !strings.Contains(resp.Results[0].Error, "истории") {
+		t.Errorf("ошибка истории не вернулась в пакете: %+v", resp.Results[0])
+	}
+	if n := countCells(); n != 0 {
+		t.Errorf("после отмены пакета сохранено клеток: %d", n)
+	}
+}
+
+func TestValidateRingUsesRoundedPositions(t *testing.T) {
+	tests := []struct {
+		name    string
+		spawns  int
+		radius  int
+		wantErr bool
+	}{
+		// Хорда 2*3*sin(pi/9) ~ 2.05 больше 2*spawn_radius, но после
+		// округления центров соседние spawn пересекаются
+		{"округление сближает spawn", 9, 3, true},
+		{"spawn помещаются", 4, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{Width: 20, Height: 20, Spawns: tt.spawns, SpawnR: 1, Strategy: "ring", RingRadius: tt.radius}
+			if err := validateRing(cfg); (err != nil) != tt.wantErr {
+				t.Fatalf("validateRing: %v, ожидалась ошибка: %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			spawns := ringSpawns(cfg)
+			for i, c := range spawns {
+				if !canPlaceAmong(cfg, spawns[:i], c) {
+					t.Errorf("spawn %d на кольце не размещается: %+v", i, c)
+				}
+			}
+		})
+	}
+}
+
+func TestAddCircleValidation(t *testing.T) {
+	openTestDB(t)
+	mapID := createTestMap(t, `{"width":20,"height":20,"spawn_count":0,"bedroom_count":0,"spawn_radius":2,"bedroom_radius":2,"center_radius":1}`)
+	path := fmt.Sprintf("/api/maps/%d/circles", mapID)
+
+	tests := []struct {
+		name     string
+		circle   string
+		want     int
+		wantType string
+	}{
+		{"неизвестный тип", `{"x":5,"y":5,"radius":2,"type":"room"}`, http.StatusBadRequest, ""},
+		{"радиус не больше center_radius", `{"x":5,"y":5,"radius":1,"type":"spawn"}`, http.StatusBadRequest, ""},
+		{"без типа - bedroom", `{"x":5,"y":5,"radius":2}`, http.StatusOK, "bedroom"},
+		{"spawn", `{"x":12,"y":12,"radius":2,"type":"spawn"}`, http.StatusOK, "spawn"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(http.MethodPost, path, tt.circle)
+			if rec.Code != tt.want {
+				t.Fatalf("статус %d, ожидался %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+			if tt.wantType == "" {
+				return
+			}
+			var resp struct {
+				Index   int      `json:"index"`
+				Circles []Circle `json:"circles"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("ответ: %v", err)
+			}
+			if got := resp.Circles[resp.Index].Type; got != tt.wantType {
+				t.Errorf("тип круга %q, ожидался %q", got, tt.wantType)
+			}
+		})
+	}
+}